@@ -1,16 +1,26 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 
 	"github.com/hightemp/proxy_parser_checker/internal/checker"
 	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+	"github.com/hightemp/proxy_parser_checker/internal/export"
+	"github.com/hightemp/proxy_parser_checker/internal/gateway"
 	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/models/site"
 	"github.com/hightemp/proxy_parser_checker/internal/parser"
 	"github.com/hightemp/proxy_parser_checker/internal/server"
+	"github.com/hightemp/proxy_parser_checker/internal/storage"
+	"github.com/hightemp/proxy_parser_checker/internal/usage"
+	"github.com/hightemp/proxy_parser_checker/internal/webhook"
 )
 
 const (
@@ -25,6 +35,7 @@ func main() {
 	logger.LogInfo("proxy_parser_checker Version: %s", VERSION)
 
 	configPath := flag.String("config", "config.yaml", "path to config file")
+	dataDir := flag.String("data-dir", "", "directory for proxy and site files, overrides data_dir")
 	flag.Parse()
 
 	err := config.Load(*configPath)
@@ -34,16 +45,120 @@ func main() {
 	}
 
 	cfg := config.GetConfig()
-	logger.LogDebug("Config loaded")
+	if *dataDir != "" {
+		cfg.DataDir = *dataDir
+	}
+	logger.LogDebug("Config loaded, data dir: %s", cfg.DataDir)
+
+	proxyStore, siteStore, err := storage.Open(cfg)
+	if err != nil {
+		logger.PanicError("%v", err)
+	}
+	defer proxyStore.Close()
+	defer siteStore.Close()
+
+	proxy.SetStore(proxyStore)
+	proxy.SetWorkProxiesPath(filepath.Join(cfg.DataDir, storage.WORK_PROXIES_FILE))
+	site.SetStore(siteStore)
+
+	proxy.Watch(events.ProxyChanged)
+	if err := proxy.Load(); err != nil {
+		logger.PanicError("%v", err)
+	}
+
+	chains := make([]proxy.Proxy, 0, len(cfg.Chains))
+	for _, c := range cfg.Chains {
+		chain, err := proxy.NewChain(c.Name, c.Hops, c.Country, c.Tags)
+		if err != nil {
+			logger.PanicError("%v", err)
+		}
+		chains = append(chains, chain)
+	}
+	proxy.SetChains(chains)
+
+	usage.SetPath(filepath.Join(cfg.DataDir, storage.USAGE_FILE))
+	if err := usage.Load(); err != nil {
+		logger.LogError("Can't load usage: %v", err)
+	}
 
 	go server.Start()
 
+	ctx, cancel := context.WithCancel(context.Background())
+
+	go storage.RunFlusher(ctx, cfg.FlushIntervalDuration, flush)
+
+	if cfg.Gateway.Enabled {
+		go gateway.Start(ctx, cfg)
+	}
+	if cfg.Gateway.Socks5.Enabled {
+		go gateway.StartSocks5(ctx, cfg)
+	}
+
+	checker.OnCycleComplete(func() {
+		export.WriteFiles(cfg)
+	})
+
+	if err := webhook.Start(ctx, cfg); err != nil {
+		logger.PanicError("%v", err)
+	}
+
 	go parser.Loop(cfg)
-	go checker.Loop(cfg)
+	stopChecker := startChecker(ctx, cfg)
 
 	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	sig := <-sigChan
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+
+	for sig := range sigChan {
+		logger.LogDebug("Received signal: %v", sig)
+		if sig != syscall.SIGHUP {
+			break
+		}
+
+		// A reload cancels the checks in flight, they are rescheduled and
+		// run again with the new settings.
+		stopChecker()
+		if err := config.ReloadChecker(*configPath); err != nil {
+			logger.LogError("Can't reload config, keeping the checker settings: %v", err)
+		} else {
+			logger.LogInfo("Checker settings reloaded")
+		}
+		stopChecker = startChecker(ctx, cfg)
+	}
+
+	cancel()
+	stopChecker()
+
+	logger.LogInfo("Flushing state before exit")
+	flush()
+}
+
+// startChecker runs the checker until the returned function is called or
+// ctx is done. The function waits for the checks in flight.
+func startChecker(ctx context.Context, cfg *config.Config) func() {
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		checker.Loop(ctx, cfg)
+		close(done)
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
 
-	logger.LogDebug("Received signal: %v", sig)
+func flush() {
+	if err := proxy.Save(); err != nil {
+		logger.LogError("Can't save proxies: %v", err)
+	}
+	if err := proxy.SaveWorkProxies(); err != nil {
+		logger.LogError("Can't save working proxies: %v", err)
+	}
+	if err := site.Save(); err != nil {
+		logger.LogError("Can't save sites: %v", err)
+	}
+	if err := usage.Save(); err != nil {
+		logger.LogError("Can't save usage: %v", err)
+	}
 }
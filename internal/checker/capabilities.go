@@ -0,0 +1,38 @@
+package checker
+
+import (
+	"context"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/upstream"
+)
+
+const (
+	defaultHttpCheckURL   = "http://checkip.amazonaws.com"
+	defaultConnectAddress = "portquiz.net:8080"
+)
+
+func httpCheckURL(cfg *config.CapabilitiesCheckConfig) string {
+	if cfg.HttpUrl != "" {
+		return cfg.HttpUrl
+	}
+	return defaultHttpCheckURL
+}
+
+func connectAddress(cfg *config.CapabilitiesCheckConfig) string {
+	if cfg.ConnectAddress != "" {
+		return cfg.ConnectAddress
+	}
+	return defaultConnectAddress
+}
+
+func checkConnectAnyPort(ctx context.Context, p *proxy.Proxy, cfg *config.CapabilitiesCheckConfig, timeout time.Duration) bool {
+	conn, err := upstream.Dial(ctx, p, connectAddress(cfg), timeout)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -2,33 +2,54 @@ package checker
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
-	"fmt"
+	"net"
 	"net/http"
-	"net/url"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hightemp/proxy_parser_checker/internal/config"
 	"github.com/hightemp/proxy_parser_checker/internal/logger"
 	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/upstream"
 )
 
 var (
 	mtx          sync.Mutex
-	CheckRate    float32 = 0
+	checkRate    float32 = 0
 	checkCounter int     = 0
 )
 
+var cycleHooks []func()
+
+// OnCycleComplete registers fn to be called every time all due proxies have
+// been checked. Hooks must be registered before Loop starts. They run on a
+// separate goroutine, so a slow hook delays the next hook run, not the
+// checks.
+func OnCycleComplete(fn func()) {
+	cycleHooks = append(cycleHooks, fn)
+}
+
+func GetCheckRate() float32 {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	return checkRate
+}
+
 type ProxyChecker struct {
 	proxyChan  chan *proxy.Proxy
+	wg         sync.WaitGroup
+	inFlight   atomic.Int64
 	maxWorkers int
 }
 
-func NewProxyChecker(cfg *config.Config) *ProxyChecker {
+func NewProxyChecker(ctx context.Context, cfg *config.Config) *ProxyChecker {
 	maxWorkers := cfg.CheckerMaxWorkers
 	if maxWorkers == 0 {
 		maxWorkers = runtime.NumCPU() * 4
@@ -40,18 +61,33 @@ func NewProxyChecker(cfg *config.Config) *ProxyChecker {
 	}
 
 	for i := 0; i < maxWorkers; i++ {
-		go pc.worker()
+		pc.wg.Add(1)
+		go pc.worker(ctx)
 	}
 
 	return pc
 }
 
-func (pc *ProxyChecker) worker() {
+func (pc *ProxyChecker) worker(ctx context.Context) {
+	defer pc.wg.Done()
+
 	for p := range pc.proxyChan {
-		checkProxy(p)
+		if ctx.Err() != nil {
+			reschedule(p)
+		} else {
+			checkProxy(ctx, p)
+		}
+		pc.inFlight.Add(-1)
 	}
 }
 
+// Stop waits for the checks in flight to finish after the context passed to
+// NewProxyChecker is cancelled.
+func (pc *ProxyChecker) Stop() {
+	close(pc.proxyChan)
+	pc.wg.Wait()
+}
+
 var checkURLs = []string{
 	"https://api.ipify.org?format=json",
 	"https://ifconfig.me/ip",
@@ -63,81 +99,198 @@ type proxyCheckResult struct {
 	success    bool
 	pingTime   time.Duration
 	detectedIP string
+	timings    proxy.Timings
 }
 
-func checkProxy(lastProxy *proxy.Proxy) {
-	mtx.Lock()
-	lastProxy.LastCheckedTime = time.Now()
-	lastProxy.IsWork = false
-	mtx.Unlock()
-
-	proxyURL := fmt.Sprintf("%s://%s:%s", lastProxy.Protocol, lastProxy.Ip, lastProxy.Port)
-	proxyUrlParsed, err := url.Parse(proxyURL)
-	if err != nil {
-		logger.LogError("[checker] Failed to parse proxy URL: %v", err)
-		return
-	}
+// checkProxy checks a copy of the proxy and applies the result to the stored
+// one with proxy.Modify.
+func checkProxy(ctx context.Context, lastProxy *proxy.Proxy) {
+	cfg := config.GetConfig()
+	startTime := time.Now()
 
 	transport := &http.Transport{
-		Proxy:             http.ProxyURL(proxyUrlParsed),
-		DisableKeepAlives: true,
-		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		DisableKeepAlives:     true,
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout:   cfg.TlsTimeoutDuration,
+		ResponseHeaderTimeout: cfg.FirstByteTimeoutDuration,
 	}
+	upstream.SetupTransport(transport, lastProxy, cfg.ConnectTimeoutDuration)
 
 	client := &http.Client{
 		Transport: transport,
-		Timeout:   time.Second * 5,
+		Timeout:   cfg.CheckTimeoutDuration,
 	}
 
+	requireIPMatch := cfg.RequireIpMatch
+
 	var results []proxyCheckResult
 	var totalPingTime time.Duration
+	// Exit IPs by judge, exitIP is the latest one.
+	exitIPs := make(map[string]string)
+	exitIP := ""
 
 	for _, checkURL := range checkURLs {
-		result := checkSingleURL(client, checkURL)
-		if result.success && result.detectedIP == lastProxy.Ip {
+		result := checkSingleURL(ctx, client, checkURL)
+		if isAccepted(result, lastProxy, requireIPMatch) {
 			results = append(results, result)
 			totalPingTime += result.pingTime
+			exitIPs[checkURL] = result.detectedIP
+			exitIP = result.detectedIP
 		}
 	}
 
 	successRate := float64(len(results)) / float64(len(checkURLs))
 
+	var capabilities []string
+	capabilitiesCfg := &cfg.CapabilitiesCheck
+
+	httpURL := httpCheckURL(capabilitiesCfg)
+	httpResult := checkSingleURL(ctx, client, httpURL)
+	httpForward := isAccepted(httpResult, lastProxy, requireIPMatch)
+	if httpForward {
+		exitIPs[httpURL] = httpResult.detectedIP
+		exitIP = httpResult.detectedIP
+		capabilities = append(capabilities, proxy.CAP_HTTP_FORWARD)
+	}
+	if successRate > 0.5 {
+		capabilities = append(capabilities, proxy.CAP_CONNECT_443)
+	}
+	if checkConnectAnyPort(ctx, lastProxy, capabilitiesCfg, cfg.ConnectTimeoutDuration) {
+		capabilities = append(capabilities, proxy.CAP_CONNECT_ANY)
+	}
+
+	// A proxy that only forwards plain HTTP is still usable, its latency is
+	// taken from the plain HTTP request.
+	if successRate <= 0.5 && httpForward {
+		results = []proxyCheckResult{httpResult}
+		totalPingTime = httpResult.pingTime
+	}
+
+	tamperReason := ""
+	integrityCfg := &cfg.IntegrityCheck
+	if len(results) > 0 && integrityCfg.Enabled {
+		reason, err := checkIntegrity(ctx, client, integrityCfg)
+		if err != nil {
+			logger.LogError("[checker] Integrity check failed: %v", err)
+		}
+		tamperReason = reason
+	}
+
+	var throughput float64
+	throughputCfg := &cfg.ThroughputCheck
+	if len(results) > 0 && tamperReason == "" && throughputCfg.Enabled {
+		throughputClient := &http.Client{
+			Transport: transport,
+			Timeout:   throughputCfg.TimeoutDuration,
+		}
+		var err error
+		throughput, err = measureThroughput(ctx, throughputClient, throughputCfg)
+		if err != nil {
+			logger.LogError("[checker] Throughput check failed: %v", err)
+		}
+	}
+
+	// A check interrupted by shutdown says nothing about the proxy, so it is
+	// rescheduled instead of being counted as a failure.
+	if ctx.Err() != nil {
+		reschedule(lastProxy)
+		return
+	}
+
 	mtx.Lock()
 	checkCounter++
-	if successRate > 0.5 {
-		lastProxy.IsWork = true
-		lastProxy.PingTime = totalPingTime / time.Duration(len(results))
-		lastProxy.SuccessCount++
-		logger.LogInfo("[checker] Proxy checked successfully. Success rate: %.2f, Average ping time: %v",
-			successRate, lastProxy.PingTime)
-	} else {
-		lastProxy.FailsCount++
+	mtx.Unlock()
+
+	// LastCheckedTime was set when the proxy was dispatched and is left as
+	// it is: a Recheck during the check has zeroed it, so the proxy is
+	// checked again instead of waiting for the next period.
+	checkedProxy, ok := proxy.Modify(lastProxy.Key(), func(p *proxy.Proxy) {
+		p.IsWork = false
+		p.Capabilities = capabilities
+		p.Throughput = throughput
+		p.RecordExitIps(exitIPs, exitIP)
+		p.IsTampered = tamperReason != ""
+		p.TamperReason = tamperReason
+		if p.IsTampered {
+			p.FailsCount++
+		} else if successRate > 0.5 || httpForward {
+			p.IsWork = true
+			p.PingTime = totalPingTime / time.Duration(len(results))
+			p.Timings = averageTimings(results)
+			p.SuccessCount++
+			p.Traffic.FailStreak = 0
+		} else {
+			p.FailsCount++
+		}
+		p.AdjustScore(p.IsWork, proxy.CheckScoreWeight)
+	})
+	if !ok {
+		logger.LogDebug("[checker] Proxy '%s:%s' was deleted during the check", lastProxy.Ip, lastProxy.Port)
+		return
+	}
+
+	outcome := "failed"
+	switch {
+	case checkedProxy.IsTampered:
+		outcome = "tampered"
+	case checkedProxy.IsWork:
+		outcome = "working"
+	}
+	checksTotal.Inc(outcome)
+	checkDuration.Observe(time.Since(startTime).Seconds(), outcome)
+
+	switch {
+	case checkedProxy.IsTampered:
+		logger.LogError("[checker] Proxy tampers with traffic: %s", tamperReason)
+	case checkedProxy.IsWork:
+		logger.LogInfo("[checker] Proxy checked successfully. Success rate: %.2f, Average ping time: %v, Capabilities: %v, Exit IP: %s, Throughput: %.2f KB/s",
+			successRate, checkedProxy.PingTime, capabilities, checkedProxy.ExitIp, throughput)
+		logger.LogDebug("[checker][!] Found proxy: %s '%s:%s'", checkedProxy.Protocol, checkedProxy.Ip, checkedProxy.Port)
+	default:
 		logger.LogError("[checker] Proxy check failed. Success rate: %.2f", successRate)
 	}
-	mtx.Unlock()
+}
 
-	if lastProxy.IsWork {
-		logger.LogDebug("[checker][!] Found proxy: %s '%s:%s'", lastProxy.Protocol, lastProxy.Ip, lastProxy.Port)
-		proxy.SaveWorkProxies()
-		proxy.Save()
+// reschedule puts a proxy whose check was interrupted back into the queue.
+func reschedule(p *proxy.Proxy) {
+	proxy.Modify(p.Key(), func(p *proxy.Proxy) {
+		p.LastCheckedTime = time.Time{}
+	})
+}
+
+// isAccepted reports whether a judge response counts as a success. The exit IP
+// has to match the proxy IP only when require_ip_match is set, otherwise
+// gateways with a different exit address are accepted too.
+func isAccepted(result proxyCheckResult, p *proxy.Proxy, requireIPMatch bool) bool {
+	if !result.success {
+		return false
 	}
+	return !requireIPMatch || result.detectedIP == p.ExitHop().Ip
 }
 
-func checkSingleURL(client *http.Client, checkURL string) proxyCheckResult {
+func checkSingleURL(ctx context.Context, client *http.Client, checkURL string) proxyCheckResult {
 	result := proxyCheckResult{success: false}
 
+	req, err := http.NewRequestWithContext(withTimings(ctx, &result.timings), http.MethodGet, checkURL, nil)
+	if err != nil {
+		logger.LogError("[checker] Can't create request to %s: %v", checkURL, err)
+		return result
+	}
+
 	startTime := time.Now()
-	resp, err := client.Get(checkURL)
+	resp, err := client.Do(req)
 	result.pingTime = time.Since(startTime)
 
 	if err != nil {
 		logger.LogError("[checker] Request to %s failed: %v", checkURL, err)
+		checkErrorsTotal.Inc(errorClass(err))
 		return result
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		logger.LogError("[checker] Bad response status from %s: %d", checkURL, resp.StatusCode)
+		checkErrorsTotal.Inc("status")
 		return result
 	}
 
@@ -145,67 +298,126 @@ func checkSingleURL(client *http.Client, checkURL string) proxyCheckResult {
 	_, err = bodyBuffer.ReadFrom(resp.Body)
 	if err != nil {
 		logger.LogError("[checker] Can't read body from %s: %v", checkURL, err)
+		checkErrorsTotal.Inc(errorClass(err))
 		return result
 	}
 
 	if ip := extractIP(bodyBuffer.String(), checkURL); ip != "" {
 		result.success = true
 		result.detectedIP = ip
+		checkLatency.Observe(result.pingTime.Seconds())
 		logger.LogInfo("[checker] Successfully checked %s, detected IP: %s", checkURL, ip)
+	} else {
+		checkErrorsTotal.Inc("bad_body")
 	}
 
 	return result
 }
 
+// extractIP returns the IP address in a judge response, or an empty string if
+// the response holds anything else, like a captive portal or an error page.
 func extractIP(body, checkURL string) string {
+	ip := ""
 	switch {
 	case checkURL == "https://api.ipify.org?format=json":
 		var response map[string]interface{}
 		if err := json.Unmarshal([]byte(body), &response); err == nil {
-			if ip, ok := response["ip"].(string); ok {
-				return ip
-			}
+			ip, _ = response["ip"].(string)
 		}
 	case checkURL == "https://api.myip.com":
 		var response map[string]interface{}
 		if err := json.Unmarshal([]byte(body), &response); err == nil {
-			if ip, ok := response["ip"].(string); ok {
-				return ip
-			}
+			ip, _ = response["ip"].(string)
 		}
 	default:
-		return strings.TrimSpace(body)
+		ip = strings.TrimSpace(body)
+	}
+
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ""
 	}
-	return ""
+	return parsed.String()
 }
 
-func Loop(cfg *config.Config) {
+// runCycleHooks calls the cycle hooks once for every signal on cycles. Cycles
+// completed while the hooks run are merged into one more run.
+func runCycleHooks(ctx context.Context, cycles <-chan struct{}) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-cycles:
+		}
+		for _, fn := range cycleHooks {
+			fn()
+		}
+	}
+}
+
+// Loop feeds expired proxies to the workers until ctx is cancelled and
+// returns after the checks in flight are finished.
+func Loop(ctx context.Context, cfg *config.Config) {
 	go func() {
 		t := time.NewTicker(60 * time.Second)
-		for range t.C {
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+			}
 			mtx.Lock()
-			CheckRate = float32(checkCounter) / 60
+			checkRate = float32(checkCounter) / 60
 			checkCounter = 0
-			logger.LogDebug("[checker] Check rate: %f proxies per second", CheckRate)
+			logger.LogDebug("[checker] Check rate: %f proxies per second", checkRate)
 			mtx.Unlock()
 		}
 	}()
 	proxy.SetCheckPeriodDuration(cfg.CheckPeriodDuration)
 
-	pc := NewProxyChecker(cfg)
+	pc := NewProxyChecker(ctx, cfg)
+	defer pc.Stop()
+	activeChecker.Store(pc)
+
+	cycles := make(chan struct{}, 1)
+	go runCycleHooks(ctx, cycles)
+
+	dispatched := 0
 
 	for {
-		mtx.Lock()
 		lastProxy := proxy.GetLastNotCheckedOne()
-		mtx.Unlock()
 
 		if lastProxy == nil {
+			if dispatched > 0 && pc.inFlight.Load() == 0 {
+				logger.LogInfo("[checker] Check cycle completed, %d proxies checked", dispatched)
+				dispatched = 0
+				select {
+				case cycles <- struct{}{}:
+				default:
+					logger.LogDebug("[checker] Cycle hooks still running, the next run is already queued")
+				}
+			}
+
 			logger.LogDebug("[checker] No proxy found")
-			time.Sleep(10 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-proxy.RecheckRequested():
+			case <-time.After(10 * time.Second):
+			}
 			continue
 		}
 
 		logger.LogDebug("[checker] Checking proxy: %s '%s:%s'", lastProxy.Protocol, lastProxy.Ip, lastProxy.Port)
-		pc.proxyChan <- lastProxy
+		pc.inFlight.Add(1)
+		select {
+		case <-ctx.Done():
+			pc.inFlight.Add(-1)
+			reschedule(lastProxy)
+			return
+		case pc.proxyChan <- lastProxy:
+			dispatched++
+		}
 	}
 }
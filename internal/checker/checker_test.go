@@ -0,0 +1,167 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+func TestExtractIP(t *testing.T) {
+	tests := []struct {
+		body     string
+		checkURL string
+		ip       string
+	}{
+		{"1.2.3.4\n", "https://checkip.amazonaws.com", "1.2.3.4"},
+		{"  2001:db8::1 ", "https://ipv4.icanhazip.com", "2001:db8::1"},
+		{`{"ip":"1.2.3.4"}`, "https://api.ipify.org?format=json", "1.2.3.4"},
+		{`{"ip":"5.6.7.8","country":"US","cc":"US"}`, "https://api.myip.com", "5.6.7.8"},
+		{`{"ip":"not an ip"}`, "https://api.ipify.org?format=json", ""},
+		{`{"ip":1234}`, "https://api.myip.com", ""},
+		{"1.2.3.4", "https://api.ipify.org?format=json", ""},
+		{"<html><body>Login to the hotspot</body></html>", "https://checkip.amazonaws.com", ""},
+		{"", "https://checkip.amazonaws.com", ""},
+	}
+	for _, tt := range tests {
+		if got := extractIP(tt.body, tt.checkURL); got != tt.ip {
+			t.Errorf("%s from %q: '%s', want '%s'", tt.checkURL, tt.body, got, tt.ip)
+		}
+	}
+}
+
+func TestIsAccepted(t *testing.T) {
+	p := &proxy.Proxy{Ip: "1.2.3.4", Port: "3128", Protocol: proxy.PROTO_HTTP}
+	chain := &proxy.Proxy{Protocol: proxy.PROTO_CHAIN, Hops: []proxy.Proxy{
+		{Ip: "1.2.3.4", Port: "3128", Protocol: proxy.PROTO_HTTP},
+		{Ip: "5.6.7.8", Port: "1080", Protocol: proxy.PROTO_SOCKS5},
+	}}
+
+	tests := []struct {
+		name           string
+		result         proxyCheckResult
+		p              *proxy.Proxy
+		requireIPMatch bool
+		accepted       bool
+	}{
+		{"failed", proxyCheckResult{detectedIP: "1.2.3.4"}, p, false, false},
+		{"same ip", proxyCheckResult{success: true, detectedIP: "1.2.3.4"}, p, true, true},
+		{"other exit ip", proxyCheckResult{success: true, detectedIP: "9.9.9.9"}, p, false, true},
+		{"other exit ip required to match", proxyCheckResult{success: true, detectedIP: "9.9.9.9"}, p, true, false},
+		{"chain exit hop", proxyCheckResult{success: true, detectedIP: "5.6.7.8"}, chain, true, true},
+		{"chain entry hop", proxyCheckResult{success: true, detectedIP: "1.2.3.4"}, chain, true, false},
+	}
+	for _, tt := range tests {
+		if got := isAccepted(tt.result, tt.p, tt.requireIPMatch); got != tt.accepted {
+			t.Errorf("%s: accepted %v, want %v", tt.name, got, tt.accepted)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	ctx := context.Background()
+	const rate = 10000
+
+	// The bucket starts full.
+	start := time.Now()
+	if err := l.wait(ctx, rate, rate); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("full bucket waited %v", elapsed)
+	}
+
+	// An empty bucket waits for the bytes to refill.
+	start = time.Now()
+	if err := l.wait(ctx, rate/5, rate); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("empty bucket waited %v, want about 200ms", elapsed)
+	}
+
+	// Refunded bytes are available at once, but never more than a second
+	// of them.
+	l.refund(rate * 10)
+	start = time.Now()
+	if err := l.wait(ctx, rate, rate); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("refunded bucket waited %v", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	if err := l.wait(ctx, rate*10, rate); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("wait past the deadline: %v", err)
+	}
+
+	if err := l.wait(context.Background(), rate*10, 0); err != nil {
+		t.Errorf("wait without a limit: %v", err)
+	}
+}
+
+func TestAverageTimings(t *testing.T) {
+	if got := averageTimings(nil); got != (proxy.Timings{}) {
+		t.Errorf("no results: %+v", got)
+	}
+
+	results := []proxyCheckResult{
+		{timings: proxy.Timings{Dns: 10 * time.Millisecond, Connect: 100 * time.Millisecond, Tls: 0, Ttfb: 300 * time.Millisecond}},
+		{timings: proxy.Timings{Dns: 0, Connect: 200 * time.Millisecond, Tls: 60 * time.Millisecond, Ttfb: 500 * time.Millisecond}},
+	}
+	want := proxy.Timings{
+		Dns:     5 * time.Millisecond,
+		Connect: 150 * time.Millisecond,
+		Tls:     30 * time.Millisecond,
+		Ttfb:    400 * time.Millisecond,
+	}
+	if got := averageTimings(results); got != want {
+		t.Errorf("average %+v, want %+v", got, want)
+	}
+}
+
+// timeoutError is a net.Error that timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	opError := func(err error) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", err)}
+	}
+
+	tests := []struct {
+		err   error
+		class string
+	}{
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("Get: %w", context.DeadlineExceeded), "timeout"},
+		{&net.OpError{Op: "read", Net: "tcp", Err: timeoutError{}}, "timeout"},
+		{&net.DNSError{Err: "no such host", Name: "judge.example"}, "dns"},
+		{opError(syscall.ECONNREFUSED), "refused"},
+		{opError(syscall.ECONNRESET), "reset"},
+		{opError(syscall.EPIPE), "reset"},
+		{tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, "tls"},
+		{errors.New("remote error: tls: handshake failure"), "tls"},
+		{errors.New("proxyconnect tcp: EOF"), "proxy"},
+		{errors.New("socks connect tcp 1.2.3.4:1080->judge.example:443: unknown error"), "proxy"},
+		{errors.New("unexpected EOF"), "other"},
+	}
+	for _, tt := range tests {
+		if got := errorClass(tt.err); got != tt.class {
+			t.Errorf("%v: class '%s', want '%s'", tt.err, got, tt.class)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+)
+
+var defaultInjectionMarkers = []string{
+	"<script",
+	"<iframe",
+	"document.write",
+	"eval(",
+}
+
+// integrityReference is the judge page as fetched without a proxy. It is
+// never changed once loaded, a reload with other settings loads a new one.
+type integrityReference struct {
+	key     string
+	sha256  string
+	markers map[string]int
+}
+
+var (
+	referenceMtx sync.Mutex
+	reference    *integrityReference
+)
+
+// referenceKey identifies the settings a reference was loaded with.
+func referenceKey(cfg *config.IntegrityCheckConfig) string {
+	return strings.Join(append([]string{cfg.Url, normalizeHex(cfg.BodySha256)}, injectionMarkers(cfg)...), "\n")
+}
+
+// loadReference fetches the judge page directly (without a proxy) and
+// remembers its hash and marker counts, so proxied responses can be compared
+// against it. The page is fetched again when the settings change.
+func loadReference(cfg *config.IntegrityCheckConfig) (*integrityReference, error) {
+	referenceMtx.Lock()
+	defer referenceMtx.Unlock()
+
+	key := referenceKey(cfg)
+	if reference != nil && reference.key == key {
+		return reference, nil
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Get(cfg.Url)
+	if err != nil {
+		return nil, fmt.Errorf("Can't get reference '%s': %v", cfg.Url, err)
+	}
+	defer resp.Body.Close()
+
+	if !isSuccessStatus(resp.StatusCode) {
+		return nil, fmt.Errorf("Bad response status of reference '%s': %d", cfg.Url, resp.StatusCode)
+	}
+
+	bodyBuffer := new(bytes.Buffer)
+	if _, err := bodyBuffer.ReadFrom(resp.Body); err != nil {
+		return nil, fmt.Errorf("Can't read reference body: %v", err)
+	}
+
+	r := &integrityReference{key: key, sha256: normalizeHex(cfg.BodySha256)}
+	if r.sha256 == "" {
+		r.sha256 = bodySha256(bodyBuffer.Bytes())
+	} else if r.sha256 != bodySha256(bodyBuffer.Bytes()) {
+		logger.LogWarning("[checker] Reference body of '%s' doesn't match configured body_sha256", cfg.Url)
+	}
+	r.markers = countMarkers(bodyBuffer.String(), injectionMarkers(cfg))
+	reference = r
+
+	return r, nil
+}
+
+func isSuccessStatus(status int) bool {
+	return status >= 200 && status < 300
+}
+
+func injectionMarkers(cfg *config.IntegrityCheckConfig) []string {
+	if len(cfg.InjectionMarkers) > 0 {
+		return cfg.InjectionMarkers
+	}
+	return defaultInjectionMarkers
+}
+
+func bodySha256(body []byte) string {
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:])
+}
+
+func normalizeHex(s string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(s), ":", ""))
+}
+
+func countMarkers(body string, markers []string) map[string]int {
+	lowerBody := strings.ToLower(body)
+	result := make(map[string]int, len(markers))
+	for _, m := range markers {
+		result[m] = strings.Count(lowerBody, strings.ToLower(m))
+	}
+	return result
+}
+
+// checkIntegrity requests the judge through the proxy and returns a non-empty
+// reason when the proxy tampered with the TLS session or the response body.
+func checkIntegrity(ctx context.Context, client *http.Client, cfg *config.IntegrityCheckConfig) (string, error) {
+	ref, err := loadReference(cfg)
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Url, nil)
+	if err != nil {
+		return "", fmt.Errorf("Can't create request to %s: %v", cfg.Url, err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("Request to %s failed: %v", cfg.Url, err)
+	}
+	defer resp.Body.Close()
+
+	if reason := checkCertificate(resp, cfg); reason != "" {
+		return reason, nil
+	}
+	// Error and captcha pages come from the judge or the proxy refusing the
+	// request, they say nothing about the body being modified.
+	if !isSuccessStatus(resp.StatusCode) {
+		return "", fmt.Errorf("Bad response status from %s: %d", cfg.Url, resp.StatusCode)
+	}
+
+	bodyBuffer := new(bytes.Buffer)
+	if _, err := bodyBuffer.ReadFrom(resp.Body); err != nil {
+		return "", fmt.Errorf("Can't read body from %s: %v", cfg.Url, err)
+	}
+
+	if bodySha256(bodyBuffer.Bytes()) == ref.sha256 {
+		return "", nil
+	}
+
+	markers := countMarkers(bodyBuffer.String(), injectionMarkers(cfg))
+	for m, count := range markers {
+		if count > ref.markers[m] {
+			return fmt.Sprintf("injected content: '%s'", m), nil
+		}
+	}
+
+	return "body modified", nil
+}
+
+func checkCertificate(resp *http.Response, cfg *config.IntegrityCheckConfig) string {
+	if resp.TLS == nil {
+		return ""
+	}
+
+	if len(resp.TLS.PeerCertificates) == 0 {
+		return "no peer certificate"
+	}
+
+	leaf := resp.TLS.PeerCertificates[0]
+
+	if fingerprint := normalizeHex(cfg.TlsFingerprint); fingerprint != "" {
+		sum := sha256.Sum256(leaf.Raw)
+		if hex.EncodeToString(sum[:]) != fingerprint {
+			return "certificate fingerprint mismatch"
+		}
+		return ""
+	}
+
+	judgeUrl, err := url.Parse(cfg.Url)
+	if err != nil {
+		return ""
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range resp.TLS.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err = leaf.Verify(x509.VerifyOptions{
+		DNSName:       judgeUrl.Hostname(),
+		Intermediates: intermediates,
+	})
+	if err != nil {
+		return fmt.Sprintf("untrusted certificate: %v", err)
+	}
+
+	return ""
+}
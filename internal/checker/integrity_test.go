@@ -0,0 +1,145 @@
+package checker
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+)
+
+const judgePage = "<html><head><script src=\"/app.js\"></script></head><body>Judge</body></html>"
+
+// tamperingTransport stands for a proxy that rewrites the judge responses.
+type tamperingTransport struct {
+	status int
+	modify func(body string) string
+}
+
+func (tr tamperingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if tr.modify != nil {
+		body = []byte(tr.modify(string(body)))
+	}
+	if tr.status != 0 {
+		resp.StatusCode = tr.status
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+	resp.ContentLength = int64(len(body))
+	return resp, nil
+}
+
+func resetReference() {
+	referenceMtx.Lock()
+	reference = nil
+	referenceMtx.Unlock()
+}
+
+func TestCheckIntegrity(t *testing.T) {
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, judgePage)
+	}))
+	defer judge.Close()
+	resetReference()
+	defer resetReference()
+
+	cfg := &config.IntegrityCheckConfig{Enabled: true, Url: judge.URL}
+
+	tests := []struct {
+		name      string
+		transport tamperingTransport
+		reason    string
+		err       bool
+	}{
+		{"untouched", tamperingTransport{}, "", false},
+		{"injected script", tamperingTransport{modify: func(body string) string {
+			return strings.Replace(body, "</body>", "<script>ads()</script></body>", 1)
+		}}, "injected content: '<script'", false},
+		{"injected iframe", tamperingTransport{modify: func(body string) string {
+			return strings.Replace(body, "Judge", "Judge<IFRAME src=\"//ads.example\">", 1)
+		}}, "injected content: '<iframe'", false},
+		// The page already has a script, removing it injects nothing.
+		{"script removed", tamperingTransport{modify: func(body string) string {
+			return strings.Replace(body, "<script src=\"/app.js\"></script>", "", 1)
+		}}, "body modified", false},
+		{"error page", tamperingTransport{status: http.StatusForbidden, modify: func(string) string {
+			return "<html><script>captcha()</script></html>"
+		}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reason, err := checkIntegrity(context.Background(), &http.Client{Transport: tt.transport}, cfg)
+			if (err != nil) != tt.err {
+				t.Fatalf("error %v", err)
+			}
+			if reason != tt.reason {
+				t.Errorf("reason '%s', want '%s'", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestIntegrityReference(t *testing.T) {
+	var status, requests atomic.Int32
+	judge := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(int(status.Load()))
+		io.WriteString(w, judgePage)
+	}))
+	defer judge.Close()
+	resetReference()
+	defer resetReference()
+
+	cfg := &config.IntegrityCheckConfig{Enabled: true, Url: judge.URL}
+
+	status.Store(http.StatusServiceUnavailable)
+	if _, err := loadReference(cfg); err == nil {
+		t.Fatal("reference loaded from an error page")
+	}
+
+	status.Store(http.StatusOK)
+	first, err := loadReference(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first.sha256 != bodySha256([]byte(judgePage)) || first.markers["<script"] != 1 {
+		t.Errorf("reference %+v", first)
+	}
+	if again, _ := loadReference(cfg); again != first || requests.Load() != 2 {
+		t.Errorf("reference loaded again with the same settings, %d requests", requests.Load())
+	}
+
+	// Changed settings load a new reference, the old one stays as it was.
+	cfg = &config.IntegrityCheckConfig{Enabled: true, Url: judge.URL, InjectionMarkers: []string{"<object"}}
+	changed, err := loadReference(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changed == first || requests.Load() != 3 {
+		t.Fatalf("reference not reloaded, %d requests", requests.Load())
+	}
+	if _, ok := changed.markers["<script"]; ok || first.markers["<script"] != 1 {
+		t.Errorf("markers %v, old markers %v", changed.markers, first.markers)
+	}
+
+	// A configured hash is used instead of the fetched page.
+	cfg = &config.IntegrityCheckConfig{Enabled: true, Url: judge.URL, BodySha256: " AB:CD "}
+	configured, err := loadReference(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if configured.sha256 != "abcd" {
+		t.Errorf("reference hash '%s'", configured.sha256)
+	}
+}
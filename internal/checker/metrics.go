@@ -0,0 +1,73 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
+)
+
+var (
+	checksTotal = metrics.NewCounterVec("ppc_checks_total",
+		"Finished proxy checks by outcome.", "outcome")
+	checkErrorsTotal = metrics.NewCounterVec("ppc_check_errors_total",
+		"Failed check requests by error class.", "class")
+	checkDuration = metrics.NewHistogramVec("ppc_check_duration_seconds",
+		"Duration of a whole proxy check by outcome.", metrics.DurationBuckets, "outcome")
+	checkLatency = metrics.NewHistogramVec("ppc_check_latency_seconds",
+		"Latency of successful check requests through the proxy.", metrics.DurationBuckets)
+
+	// activeChecker is the checker started by Loop, read by the gauges.
+	activeChecker atomic.Pointer[ProxyChecker]
+)
+
+func init() {
+	metrics.NewGaugeFunc("ppc_checker_in_flight", "Checks dispatched to the workers and not finished yet.", nil,
+		func(emit func(v float64, values ...string)) {
+			if pc := activeChecker.Load(); pc != nil {
+				emit(float64(pc.inFlight.Load()))
+			}
+		})
+	metrics.NewGaugeFunc("ppc_checker_queue_length", "Checks waiting for a free worker.", nil,
+		func(emit func(v float64, values ...string)) {
+			if pc := activeChecker.Load(); pc != nil {
+				emit(float64(len(pc.proxyChan)))
+			}
+		})
+	metrics.NewGaugeFunc("ppc_check_rate", "Checks per second over the last minute.", nil,
+		func(emit func(v float64, values ...string)) {
+			emit(float64(GetCheckRate()))
+		})
+}
+
+// errorClass groups request errors for the error counter.
+func errorClass(err error) string {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var tlsErr tls.RecordHeaderError
+	var certErr *tls.CertificateVerificationError
+
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, syscall.EPIPE):
+		return "reset"
+	case errors.As(err, &tlsErr), errors.As(err, &certErr), strings.Contains(err.Error(), "tls:"):
+		return "tls"
+	case strings.Contains(err.Error(), "proxyconnect"), strings.Contains(err.Error(), "socks connect"):
+		return "proxy"
+	default:
+		return "other"
+	}
+}
@@ -0,0 +1,137 @@
+package checker
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+)
+
+const (
+	defaultThroughputMaxBytes = 1024 * 1024
+	throughputChunkSize       = 32 * 1024
+)
+
+// rateLimiter is a token bucket shared by all workers, so throughput tests
+// together never download faster than the configured rate.
+type rateLimiter struct {
+	mtx        sync.Mutex
+	rate       float64
+	tokens     float64
+	lastRefill time.Time
+}
+
+var throughputLimiter rateLimiter
+
+// wait charges n bytes and blocks until the bucket is no longer in debt, or
+// until ctx is done.
+func (l *rateLimiter) wait(ctx context.Context, n int, bytesPerSecond float64) error {
+	if bytesPerSecond <= 0 || n <= 0 {
+		return nil
+	}
+
+	l.mtx.Lock()
+	now := time.Now()
+	if l.rate != bytesPerSecond {
+		l.rate = bytesPerSecond
+		l.tokens = bytesPerSecond
+		l.lastRefill = now
+	}
+	l.tokens += now.Sub(l.lastRefill).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.lastRefill = now
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mtx.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+	t := time.NewTimer(delay)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// refund returns bytes charged by wait that were not downloaded.
+func (l *rateLimiter) refund(n int64) {
+	if n <= 0 {
+		return
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+
+	l.tokens = min(l.tokens+float64(n), l.rate)
+}
+
+// measureThroughput downloads up to max_bytes from the judge through the
+// proxy and returns the speed in KB/s over the wall clock time of the
+// download. The rate limit is charged for the whole download before it
+// starts, so waiting for the limiter is never part of the measured time and
+// concurrent checks are spread out instead of sharing the limit.
+func measureThroughput(ctx context.Context, client *http.Client, cfg *config.ThroughputCheckConfig) (float64, error) {
+	maxBytes := cfg.MaxBytes
+	if maxBytes == 0 {
+		maxBytes = defaultThroughputMaxBytes
+	}
+	bytesPerSecond := float64(cfg.RateLimit) * 1024
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, cfg.Url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Can't create request to %s: %v", cfg.Url, err)
+	}
+
+	if err := throughputLimiter.wait(ctx, int(maxBytes), bytesPerSecond); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	if bytesPerSecond > 0 {
+		defer func() { throughputLimiter.refund(maxBytes - total) }()
+	}
+
+	startTime := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("Request to %s failed: %v", cfg.Url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("Bad response status from %s: %d", cfg.Url, resp.StatusCode)
+	}
+
+	buf := make([]byte, throughputChunkSize)
+
+	for total < maxBytes {
+		n, err := resp.Body.Read(buf[:min(int64(len(buf)), maxBytes-total)])
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, fmt.Errorf("Can't read body from %s: %v", cfg.Url, err)
+		}
+	}
+
+	elapsed := time.Since(startTime)
+	if total == 0 || elapsed <= 0 {
+		return 0, fmt.Errorf("Nothing downloaded from %s", cfg.Url)
+	}
+
+	return float64(total) / 1024 / elapsed.Seconds(), nil
+}
@@ -0,0 +1,63 @@
+package checker
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http/httptrace"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// withTimings attaches an httptrace.ClientTrace to ctx that records the
+// duration of every request phase into t.
+func withTimings(ctx context.Context, t *proxy.Timings) context.Context {
+	var dnsStart, connectStart, tlsStart time.Time
+	start := time.Now()
+
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			dnsStart = time.Now()
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			t.Dns = time.Since(dnsStart)
+		},
+		ConnectStart: func(string, string) {
+			connectStart = time.Now()
+		},
+		ConnectDone: func(string, string, error) {
+			t.Connect = time.Since(connectStart)
+		},
+		TLSHandshakeStart: func() {
+			tlsStart = time.Now()
+		},
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			t.Tls = time.Since(tlsStart)
+		},
+		GotFirstResponseByte: func() {
+			t.Ttfb = time.Since(start)
+		},
+	})
+}
+
+func averageTimings(results []proxyCheckResult) proxy.Timings {
+	var total proxy.Timings
+	if len(results) == 0 {
+		return total
+	}
+
+	for _, r := range results {
+		total.Dns += r.timings.Dns
+		total.Connect += r.timings.Connect
+		total.Tls += r.timings.Tls
+		total.Ttfb += r.timings.Ttfb
+	}
+
+	n := time.Duration(len(results))
+	return proxy.Timings{
+		Dns:     total.Dns / n,
+		Connect: total.Connect / n,
+		Tls:     total.Tls / n,
+		Ttfb:    total.Ttfb / n,
+	}
+}
@@ -2,38 +2,253 @@ package config
 
 import (
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	y "gopkg.in/yaml.v3"
 )
 
+type IntegrityCheckConfig struct {
+	Enabled          bool     `yaml:"enabled"`
+	Url              string   `yaml:"url"`
+	BodySha256       string   `yaml:"body_sha256"`
+	TlsFingerprint   string   `yaml:"tls_fingerprint"`
+	InjectionMarkers []string `yaml:"injection_markers"`
+}
+
+type CapabilitiesCheckConfig struct {
+	HttpUrl        string `yaml:"http_url"`
+	ConnectAddress string `yaml:"connect_address"`
+}
+
+type ThroughputCheckConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	Url             string `yaml:"url"`
+	MaxBytes        int64  `yaml:"max_bytes"`
+	RateLimit       int    `yaml:"rate_limit"`
+	Timeout         string `yaml:"timeout"`
+	TimeoutDuration time.Duration
+}
+
+type LeasesConfig struct {
+	DefaultTtl         string `yaml:"default_ttl"`
+	DefaultTtlDuration time.Duration
+	MaxTtl             string `yaml:"max_ttl"`
+	MaxTtlDuration     time.Duration
+	MaxPerProxy        int `yaml:"max_per_proxy"`
+}
+
+type ReportsConfig struct {
+	BanTtl         string `yaml:"ban_ttl"`
+	BanTtlDuration time.Duration
+}
+
+type Socks5Config struct {
+	Enabled  bool   `yaml:"enabled"`
+	Listen   string `yaml:"listen"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+}
+
+// GatewayRuleConfig routes requests to matching hosts through a pool of
+// their own, directly, or blocks them.
+type GatewayRuleConfig struct {
+	Hosts  []string `yaml:"hosts"`
+	Action string   `yaml:"action"`
+	Query  string   `yaml:"query"`
+}
+
+type GatewayConfig struct {
+	Enabled             bool   `yaml:"enabled"`
+	Listen              string `yaml:"listen"`
+	Retries             int    `yaml:"retries"`
+	Mode                string `yaml:"mode"`
+	Query               string `yaml:"query"`
+	Timeout             string `yaml:"timeout"`
+	TimeoutDuration     time.Duration
+	BanTtl              string `yaml:"ban_ttl"`
+	BanTtlDuration      time.Duration
+	IdleTimeout         string `yaml:"idle_timeout"`
+	IdleTimeoutDuration time.Duration
+	Socks5              Socks5Config `yaml:"socks5"`
+	SessionTtl          string       `yaml:"session_ttl"`
+	SessionTtlDuration  time.Duration
+	SessionHeader       string              `yaml:"session_header"`
+	Rules               []GatewayRuleConfig `yaml:"rules"`
+	MaxFailStreak       int                 `yaml:"max_fail_streak"`
+}
+
+// ChainConfig is a fixed sequence of proxies checked and used as one virtual
+// proxy.
+type ChainConfig struct {
+	Name    string   `yaml:"name"`
+	Hops    []string `yaml:"hops"`
+	Country string   `yaml:"country"`
+	Tags    []string `yaml:"tags"`
+}
+
+// WebhookConfig posts the selected pool and site events to Url. Name shows
+// the webhook in the delivery log and the logs instead of Url, which may carry
+// secrets. Without it the scheme and host of Url are shown.
+type WebhookConfig struct {
+	Name                  string   `yaml:"name"`
+	Url                   string   `yaml:"url"`
+	Secret                string   `yaml:"secret"`
+	Events                []string `yaml:"events"`
+	MinWorking            int      `yaml:"min_working"`
+	Query                 string   `yaml:"query"`
+	SiteDownAfter         string   `yaml:"site_down_after"`
+	SiteDownAfterDuration time.Duration
+	MaxAttempts           int `yaml:"max_attempts"`
+}
+
+type StorageConfig struct {
+	Backend string `yaml:"backend"`
+}
+
+type ExportConfig struct {
+	Format string `yaml:"format"`
+	Path   string `yaml:"path"`
+	Query  string `yaml:"query"`
+}
+
 type Config struct {
-	SitesForParsing     []string `yaml:"sites_for_parsing"`
-	ParsePeriod         string   `yaml:"parse_period"`
-	ParsePeriodDuration time.Duration
-	CheckPeriod         string `yaml:"check_period"`
-	CheckPeriodDuration time.Duration
-	ServerPort          string `yaml:"server_port"`
-	CheckerMaxWorkers   int    `yaml:"checker_max_workers"`
-	ParserMaxWorkers    int    `yaml:"parser_max_workers"`
+	SitesForParsing          []string `yaml:"sites_for_parsing"`
+	ParsePeriod              string   `yaml:"parse_period"`
+	ParsePeriodDuration      time.Duration
+	CheckPeriod              string `yaml:"check_period"`
+	CheckPeriodDuration      time.Duration
+	ServerPort               string                  `yaml:"server_port"`
+	AllowedOrigins           []string                `yaml:"allowed_origins"`
+	CheckerMaxWorkers        int                     `yaml:"checker_max_workers"`
+	ParserMaxWorkers         int                     `yaml:"parser_max_workers"`
+	IntegrityCheck           IntegrityCheckConfig    `yaml:"integrity_check"`
+	CapabilitiesCheck        CapabilitiesCheckConfig `yaml:"capabilities_check"`
+	RequireIpMatch           bool                    `yaml:"require_ip_match"`
+	ThroughputCheck          ThroughputCheckConfig   `yaml:"throughput_check"`
+	CheckTimeout             string                  `yaml:"check_timeout"`
+	CheckTimeoutDuration     time.Duration
+	ConnectTimeout           string `yaml:"connect_timeout"`
+	ConnectTimeoutDuration   time.Duration
+	TlsTimeout               string `yaml:"tls_timeout"`
+	TlsTimeoutDuration       time.Duration
+	FirstByteTimeout         string `yaml:"first_byte_timeout"`
+	FirstByteTimeoutDuration time.Duration
+	Storage                  StorageConfig `yaml:"storage"`
+	FlushInterval            string        `yaml:"flush_interval"`
+	FlushIntervalDuration    time.Duration
+	DataDir                  string          `yaml:"data_dir"`
+	Exports                  []ExportConfig  `yaml:"exports"`
+	Leases                   LeasesConfig    `yaml:"leases"`
+	Reports                  ReportsConfig   `yaml:"reports"`
+	Gateway                  GatewayConfig   `yaml:"gateway"`
+	Chains                   []ChainConfig   `yaml:"chains"`
+	Webhooks                 []WebhookConfig `yaml:"webhooks"`
 }
 
 var c Config
 
 func Load(path string) error {
+	var loaded Config
+	if err := parse(path, &loaded); err != nil {
+		return err
+	}
+	c = loaded
+	return nil
+}
+
+// ReloadChecker reads the config file again and applies the checker
+// settings from it. The other settings are held by running servers and need
+// a restart. It must only be called while the checker is stopped.
+func ReloadChecker(path string) error {
+	var loaded Config
+	if err := parse(path, &loaded); err != nil {
+		return err
+	}
+
+	c.CheckPeriod, c.CheckPeriodDuration = loaded.CheckPeriod, loaded.CheckPeriodDuration
+	c.CheckerMaxWorkers = loaded.CheckerMaxWorkers
+	c.CheckTimeout, c.CheckTimeoutDuration = loaded.CheckTimeout, loaded.CheckTimeoutDuration
+	c.ConnectTimeout, c.ConnectTimeoutDuration = loaded.ConnectTimeout, loaded.ConnectTimeoutDuration
+	c.TlsTimeout, c.TlsTimeoutDuration = loaded.TlsTimeout, loaded.TlsTimeoutDuration
+	c.FirstByteTimeout, c.FirstByteTimeoutDuration = loaded.FirstByteTimeout, loaded.FirstByteTimeoutDuration
+	c.RequireIpMatch = loaded.RequireIpMatch
+	c.IntegrityCheck = loaded.IntegrityCheck
+	c.CapabilitiesCheck = loaded.CapabilitiesCheck
+	c.ThroughputCheck = loaded.ThroughputCheck
+	return nil
+}
+
+func parse(path string, c *Config) error {
 	text, err := os.ReadFile(path)
 
 	if err != nil {
 		return fmt.Errorf("Can't read file %s: %v", path, err)
 	}
 
-	err = y.Unmarshal(text, &c)
+	err = y.Unmarshal(text, c)
 
 	if err != nil {
 		return fmt.Errorf("Can't parse config %s: %v", path, err)
 	}
 
+	if c.Leases.MaxPerProxy < 0 {
+		return fmt.Errorf("Invalid 'Leases.MaxPerProxy': %d", c.Leases.MaxPerProxy)
+	}
+	checkUrls := []struct {
+		name    string
+		enabled bool
+		value   string
+	}{
+		{"IntegrityCheck.Url", c.IntegrityCheck.Enabled, c.IntegrityCheck.Url},
+		{"ThroughputCheck.Url", c.ThroughputCheck.Enabled, c.ThroughputCheck.Url},
+	}
+	for _, u := range checkUrls {
+		if u.enabled && !isHttpUrl(u.value) {
+			return fmt.Errorf("Invalid '%s': '%s', the check needs an http or https URL", u.name, u.value)
+		}
+	}
+	if c.Leases.MaxPerProxy == 0 {
+		c.Leases.MaxPerProxy = 1
+	}
+	for i, origin := range c.AllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		if origin != "*" {
+			u, err := url.Parse(origin)
+			if err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+				return fmt.Errorf("Invalid 'AllowedOrigins' entry '%s'", c.AllowedOrigins[i])
+			}
+		}
+		c.AllowedOrigins[i] = origin
+	}
+	if c.Gateway.Listen == "" {
+		c.Gateway.Listen = "127.0.0.1:3128"
+	}
+	if c.Gateway.Socks5.Listen == "" {
+		c.Gateway.Socks5.Listen = "127.0.0.1:1080"
+	}
+	if c.Gateway.SessionHeader == "" {
+		c.Gateway.SessionHeader = "X-Proxy-Session"
+	}
+	if c.Gateway.Retries == 0 {
+		c.Gateway.Retries = 3
+	}
+	if c.Gateway.MaxFailStreak == 0 {
+		c.Gateway.MaxFailStreak = 3
+	}
+
+	// A relative data dir is relative to the config file, not to the working
+	// directory.
+	if c.DataDir == "" {
+		c.DataDir = "out"
+	}
+	if !filepath.IsAbs(c.DataDir) {
+		c.DataDir = filepath.Join(filepath.Dir(path), c.DataDir)
+	}
+
 	c.ParsePeriodDuration, err = time.ParseDuration(c.ParsePeriod)
 
 	if err != nil {
@@ -46,9 +261,62 @@ func Load(path string) error {
 		return fmt.Errorf("Can't parse duration in 'CheckPeriod': %v", err)
 	}
 
+	durations := []struct {
+		name   string
+		value  string
+		def    time.Duration
+		target *time.Duration
+	}{
+		{"ThroughputCheck.Timeout", c.ThroughputCheck.Timeout, 30 * time.Second, &c.ThroughputCheck.TimeoutDuration},
+		{"CheckTimeout", c.CheckTimeout, 5 * time.Second, &c.CheckTimeoutDuration},
+		{"ConnectTimeout", c.ConnectTimeout, 5 * time.Second, &c.ConnectTimeoutDuration},
+		{"TlsTimeout", c.TlsTimeout, 5 * time.Second, &c.TlsTimeoutDuration},
+		{"FirstByteTimeout", c.FirstByteTimeout, 5 * time.Second, &c.FirstByteTimeoutDuration},
+		{"FlushInterval", c.FlushInterval, 10 * time.Second, &c.FlushIntervalDuration},
+		{"Leases.DefaultTtl", c.Leases.DefaultTtl, time.Minute, &c.Leases.DefaultTtlDuration},
+		{"Leases.MaxTtl", c.Leases.MaxTtl, 10 * time.Minute, &c.Leases.MaxTtlDuration},
+		{"Reports.BanTtl", c.Reports.BanTtl, 24 * time.Hour, &c.Reports.BanTtlDuration},
+		{"Gateway.Timeout", c.Gateway.Timeout, 30 * time.Second, &c.Gateway.TimeoutDuration},
+		{"Gateway.BanTtl", c.Gateway.BanTtl, 10 * time.Minute, &c.Gateway.BanTtlDuration},
+		{"Gateway.IdleTimeout", c.Gateway.IdleTimeout, 5 * time.Minute, &c.Gateway.IdleTimeoutDuration},
+		{"Gateway.SessionTtl", c.Gateway.SessionTtl, 10 * time.Minute, &c.Gateway.SessionTtlDuration},
+	}
+
+	for _, d := range durations {
+		*d.target, err = parseOptionalDuration(d.value, d.def)
+
+		if err != nil {
+			return fmt.Errorf("Can't parse duration in '%s': %v", d.name, err)
+		}
+	}
+
+	for i := range c.Webhooks {
+		w := &c.Webhooks[i]
+		if w.MaxAttempts == 0 {
+			w.MaxAttempts = 5
+		}
+		w.SiteDownAfterDuration, err = parseOptionalDuration(w.SiteDownAfter, 6*time.Hour)
+
+		if err != nil {
+			return fmt.Errorf("Can't parse duration in 'Webhooks[%d].SiteDownAfter': %v", i, err)
+		}
+	}
+
 	return nil
 }
 
+func isHttpUrl(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func parseOptionalDuration(value string, def time.Duration) (time.Duration, error) {
+	if value == "" {
+		return def, nil
+	}
+	return time.ParseDuration(value)
+}
+
 func GetConfig() *Config {
 	return &c
 }
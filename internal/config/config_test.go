@@ -0,0 +1,40 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckUrls(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		err  string
+	}{
+		{"disabled without url", "integrity_check:\n  enabled: false\nthroughput_check:\n  enabled: false\n", ""},
+		{"integrity without url", "integrity_check:\n  enabled: true\n", "IntegrityCheck.Url"},
+		{"integrity with url", "integrity_check:\n  enabled: true\n  url: https://example.com/\n", ""},
+		{"throughput without url", "throughput_check:\n  enabled: true\n", "ThroughputCheck.Url"},
+		{"throughput with bad url", "throughput_check:\n  enabled: true\n  url: example.com/file\n", "ThroughputCheck.Url"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.yaml")
+			text := "check_period: 1h\nparse_period: 1h\n" + tt.yaml
+			if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var loaded Config
+			err := parse(path, &loaded)
+			switch {
+			case tt.err == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+				t.Fatalf("error %v, want one about '%s'", err, tt.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,211 @@
+// Package events publishes changes of the proxy list and the results of site
+// parsing to the subscribers of the event stream.
+package events
+
+import (
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+const (
+	TYPE_PROXY_ADDED   = "proxy_added"
+	TYPE_PROXY_REMOVED = "proxy_removed"
+	TYPE_PROXY_WORKING = "proxy_working"
+	TYPE_PROXY_DIED    = "proxy_died"
+	TYPE_SITE_PARSED   = "site_parsed"
+	TYPE_SITE_FAILED   = "site_failed"
+
+	// A subscriber that falls this many events behind is dropped, it can
+	// reconnect and resume from the replay.
+	subscriberBuffer = 256
+	// Events kept for subscribers resuming after a disconnect.
+	replaySize = 1000
+)
+
+var types = []string{
+	TYPE_PROXY_ADDED,
+	TYPE_PROXY_REMOVED,
+	TYPE_PROXY_WORKING,
+	TYPE_PROXY_DIED,
+	TYPE_SITE_PARSED,
+	TYPE_SITE_FAILED,
+}
+
+// Site is the result of fetching and parsing a site. Parsed counts all
+// proxies found, Added only the ones new to the list.
+type Site struct {
+	Url    string `json:"url"`
+	Parsed int    `json:"parsed"`
+	Added  int    `json:"added"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Event carries the redacted view of the proxy, the proxy itself is only
+// kept for the subscriber filters.
+type Event struct {
+	Id    uint64      `json:"id"`
+	Type  string      `json:"type"`
+	Time  time.Time   `json:"time"`
+	Proxy *proxy.View `json:"proxy,omitempty"`
+	Site  *Site       `json:"site,omitempty"`
+
+	source *proxy.Proxy
+}
+
+// Filter selects the events of a subscriber. Empty Types match all types,
+// the proxy filter only applies to proxy events.
+type Filter struct {
+	Types []string
+	Proxy proxy.Filter
+}
+
+// ParseFilter reads the type parameter and the proxy filters from the query
+// string. Sorting and paging parameters are ignored.
+func ParseFilter(values url.Values) (Filter, error) {
+	f := Filter{Types: proxy.SplitList(values["type"])}
+	for _, t := range f.Types {
+		if !contains(types, t) {
+			return f, fmt.Errorf("Invalid event type '%s'", t)
+		}
+	}
+
+	var err error
+	f.Proxy, err = proxy.ParseFilter(values)
+	return f, err
+}
+
+func (f *Filter) Matches(e *Event) bool {
+	if len(f.Types) > 0 && !contains(f.Types, e.Type) {
+		return false
+	}
+	if e.source != nil && !f.Proxy.Matches(e.source) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+type subscriber struct {
+	ch     chan Event
+	filter Filter
+}
+
+var (
+	mtx    sync.Mutex
+	lastId uint64
+	// replay is a ring of the last events, the event with id n is kept at
+	// n % replaySize.
+	replay      [replaySize]Event
+	subscribers = make(map[*subscriber]struct{})
+)
+
+// Publish numbers the event and sends it to the matching subscribers. It
+// never blocks, subscribers with a full buffer are dropped by closing their
+// channel.
+func Publish(e Event) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	lastId++
+	e.Id = lastId
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	replay[e.Id%replaySize] = e
+
+	for s := range subscribers {
+		if !s.filter.Matches(&e) {
+			continue
+		}
+		select {
+		case s.ch <- e:
+		default:
+			delete(subscribers, s)
+			close(s.ch)
+		}
+	}
+}
+
+// Subscribe returns the channel of the events matching the filter. With a
+// non zero after the kept events published after that id are sent first.
+// The channel is closed when the subscriber falls behind, cancel must be
+// called when it is no longer read.
+func Subscribe(filter Filter, after uint64) (<-chan Event, func()) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	var missed []Event
+	if after > 0 {
+		first := uint64(1)
+		if lastId > replaySize {
+			first = lastId - replaySize + 1
+		}
+		for id := max(after+1, first); id <= lastId; id++ {
+			e := replay[id%replaySize]
+			if filter.Matches(&e) {
+				missed = append(missed, e)
+			}
+		}
+	}
+
+	s := &subscriber{
+		ch:     make(chan Event, subscriberBuffer+len(missed)),
+		filter: filter,
+	}
+	for _, e := range missed {
+		s.ch <- e
+	}
+	subscribers[s] = struct{}{}
+
+	cancel := func() {
+		mtx.Lock()
+		defer mtx.Unlock()
+
+		if _, ok := subscribers[s]; ok {
+			delete(subscribers, s)
+			close(s.ch)
+		}
+	}
+	return s.ch, cancel
+}
+
+var proxyTypes = map[string]string{
+	proxy.CHANGE_ADDED:   TYPE_PROXY_ADDED,
+	proxy.CHANGE_REMOVED: TYPE_PROXY_REMOVED,
+	proxy.CHANGE_WORKING: TYPE_PROXY_WORKING,
+	proxy.CHANGE_DIED:    TYPE_PROXY_DIED,
+}
+
+// ProxyChanged publishes a change of the proxy list, it is registered with
+// proxy.Watch.
+func ProxyChanged(change string, p proxy.Proxy) {
+	t, ok := proxyTypes[change]
+	if !ok {
+		return
+	}
+	v := p.View()
+	Publish(Event{Type: t, Proxy: &v, source: &p})
+}
+
+// SiteParsed publishes the result of parsing a site.
+func SiteParsed(url string, parsed, added int) {
+	Publish(Event{Type: TYPE_SITE_PARSED, Site: &Site{Url: url, Parsed: parsed, Added: added}})
+}
+
+// SiteFailed publishes a failed fetch of a site.
+func SiteFailed(url string, err error) {
+	Publish(Event{Type: TYPE_SITE_FAILED, Site: &Site{Url: url, Error: err.Error()}})
+}
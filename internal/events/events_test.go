@@ -0,0 +1,82 @@
+package events
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// received takes the events already sent to the channel.
+func received(ch <-chan Event) []Event {
+	var el []Event
+	for {
+		select {
+		case e := <-ch:
+			el = append(el, e)
+		default:
+			return el
+		}
+	}
+}
+
+func TestReplayKeepsLastEvents(t *testing.T) {
+	for i := 0; i < replaySize+500; i++ {
+		SiteParsed("https://example.com/"+strconv.Itoa(i), i, 0)
+	}
+
+	mtx.Lock()
+	last := lastId
+	mtx.Unlock()
+
+	tests := []struct {
+		after uint64
+		first uint64
+	}{
+		{last - 10, last - 9},
+		{last - replaySize, last - replaySize + 1},
+		// Events that are no longer kept are skipped.
+		{1, last - replaySize + 1},
+		{last, 0},
+	}
+	for _, tt := range tests {
+		ch, cancel := Subscribe(Filter{}, tt.after)
+		el := received(ch)
+		cancel()
+
+		if tt.first == 0 {
+			if len(el) != 0 {
+				t.Errorf("after %d: %d events replayed", tt.after, len(el))
+			}
+			continue
+		}
+		if uint64(len(el)) != last-tt.first+1 {
+			t.Fatalf("after %d: %d events replayed, want %d", tt.after, len(el), last-tt.first+1)
+		}
+		for i, e := range el {
+			if e.Id != tt.first+uint64(i) {
+				t.Fatalf("after %d: event %d has id %d, want %d", tt.after, i, e.Id, tt.first+uint64(i))
+			}
+		}
+	}
+}
+
+func TestProxyFilterOnRedactedEvents(t *testing.T) {
+	filter, err := ParseFilter(map[string][]string{"protocol": {proxy.PROTO_SOCKS5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, cancel := Subscribe(filter, 0)
+	defer cancel()
+
+	ProxyChanged(proxy.CHANGE_ADDED, proxy.Proxy{Ip: "10.0.0.1", Port: "3128", Protocol: proxy.PROTO_HTTP})
+	ProxyChanged(proxy.CHANGE_ADDED, proxy.Proxy{Ip: "10.0.0.2", Port: "1080", Protocol: proxy.PROTO_SOCKS5, Password: "secret"})
+
+	el := received(ch)
+	if len(el) != 1 {
+		t.Fatalf("%d events, want 1", len(el))
+	}
+	if el[0].Proxy.Ip != "10.0.0.2" || !el[0].Proxy.HasAuth {
+		t.Errorf("event proxy %+v", el[0].Proxy)
+	}
+}
@@ -0,0 +1,217 @@
+package export
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	FORMAT_PLAIN       = "plain"
+	FORMAT_URL         = "url"
+	FORMAT_CSV         = "csv"
+	FORMAT_JSONL       = "jsonl"
+	FORMAT_PROXYCHAINS = "proxychains"
+	FORMAT_CLASH       = "clash"
+	FORMAT_PAC         = "pac"
+)
+
+type formatter struct {
+	contentType string
+	write       func(w io.Writer, pl []proxy.Proxy) error
+}
+
+var formatters = map[string]formatter{
+	FORMAT_PLAIN:       {"text/plain; charset=utf-8", writePlain},
+	FORMAT_URL:         {"text/plain; charset=utf-8", writeURL},
+	FORMAT_CSV:         {"text/csv; charset=utf-8", writeCSV},
+	FORMAT_JSONL:       {"application/x-ndjson", writeJSONL},
+	FORMAT_PROXYCHAINS: {"text/plain; charset=utf-8", writeProxychains},
+	FORMAT_CLASH:       {"application/yaml", writeClash},
+	FORMAT_PAC:         {"application/x-ns-proxy-autoconfig", writePAC},
+}
+
+func IsValidFormat(format string) bool {
+	_, ok := formatters[format]
+	return ok
+}
+
+func ContentType(format string) string {
+	return formatters[format].contentType
+}
+
+// Write renders the proxies in the given format. Chains are left out.
+func Write(w io.Writer, format string, pl []proxy.Proxy) error {
+	f, ok := formatters[format]
+	if !ok {
+		return fmt.Errorf("Unknown export format '%s'", format)
+	}
+
+	// Chains only exist inside this service, other tools can't dial them.
+	var exported []proxy.Proxy
+	for _, p := range pl {
+		if p.Protocol != proxy.PROTO_CHAIN {
+			exported = append(exported, p)
+		}
+	}
+	return f.write(w, exported)
+}
+
+func Render(format string, pl []proxy.Proxy) ([]byte, error) {
+	var buf bytes.Buffer
+	err := Write(&buf, format, pl)
+	return buf.Bytes(), err
+}
+
+func writePlain(w io.Writer, pl []proxy.Proxy) error {
+	for _, p := range pl {
+		if _, err := fmt.Fprintln(w, net.JoinHostPort(p.Ip, p.Port)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeURL(w io.Writer, pl []proxy.Proxy) error {
+	for _, p := range pl {
+		if _, err := fmt.Fprintln(w, p.URL().String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeCSV(w io.Writer, pl []proxy.Proxy) error {
+	cw := csv.NewWriter(w)
+
+	cw.Write([]string{
+		"protocol", "ip", "port", "country", "anonymity", "score", "exit_ip", "ping_ms",
+		"throughput_kbps", "capabilities", "tags", "last_checked_time",
+	})
+	for _, p := range pl {
+		cw.Write([]string{
+			p.Protocol,
+			p.Ip,
+			p.Port,
+			p.Country,
+			p.Anonymity,
+			strconv.FormatFloat(p.Score, 'f', 1, 64),
+			p.ExitIp,
+			strconv.FormatInt(p.PingTime.Milliseconds(), 10),
+			strconv.FormatFloat(p.Throughput, 'f', 2, 64),
+			strings.Join(p.Capabilities, " "),
+			strings.Join(p.Tags, " "),
+			p.LastCheckedTime.Format(time.RFC3339),
+		})
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeJSONL(w io.Writer, pl []proxy.Proxy) error {
+	enc := json.NewEncoder(w)
+	for i := range pl {
+		if err := enc.Encode(pl[i].View()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeProxychains writes a [ProxyList] section. proxychains can't talk TLS
+// to a proxy, so https proxies are left out.
+func writeProxychains(w io.Writer, pl []proxy.Proxy) error {
+	if _, err := fmt.Fprintln(w, "[ProxyList]"); err != nil {
+		return err
+	}
+
+	for _, p := range pl {
+		if p.Protocol == proxy.PROTO_HTTPS {
+			continue
+		}
+
+		line := fmt.Sprintf("%s %s %s", p.Protocol, p.Ip, p.Port)
+		if p.Username != "" {
+			line += fmt.Sprintf(" %s %s", p.Username, p.Password)
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type clashProxy struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Server   string `yaml:"server"`
+	Port     int    `yaml:"port"`
+	Tls      bool   `yaml:"tls,omitempty"`
+	Username string `yaml:"username,omitempty"`
+	Password string `yaml:"password,omitempty"`
+}
+
+// writeClash writes the proxies: section of a Clash/mihomo config.
+func writeClash(w io.Writer, pl []proxy.Proxy) error {
+	var section struct {
+		Proxies []clashProxy `yaml:"proxies"`
+	}
+
+	for _, p := range pl {
+		port, err := strconv.Atoi(p.Port)
+		if err != nil {
+			continue
+		}
+		proxyType := "http"
+		if p.Protocol == proxy.PROTO_SOCKS5 {
+			proxyType = "socks5"
+		}
+		section.Proxies = append(section.Proxies, clashProxy{
+			Name:     p.Key(),
+			Type:     proxyType,
+			Server:   p.Ip,
+			Port:     port,
+			Tls:      p.Protocol == proxy.PROTO_HTTPS,
+			Username: p.Username,
+			Password: p.Password,
+		})
+	}
+
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(section); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// writePAC writes a proxy auto-config file that tries the proxies in order
+// and falls back to a direct connection.
+func writePAC(w io.Writer, pl []proxy.Proxy) error {
+	var entries []string
+	for _, p := range pl {
+		kind := "PROXY"
+		switch p.Protocol {
+		case proxy.PROTO_HTTPS:
+			kind = "HTTPS"
+		case proxy.PROTO_SOCKS5:
+			kind = "SOCKS5"
+		}
+		entries = append(entries, fmt.Sprintf("%s %s", kind, net.JoinHostPort(p.Ip, p.Port)))
+	}
+	entries = append(entries, "DIRECT")
+
+	_, err := fmt.Fprintf(w, "function FindProxyForURL(url, host) {\n  return %q;\n}\n", strings.Join(entries, "; "))
+	return err
+}
@@ -0,0 +1,46 @@
+package export
+
+import (
+	"net/url"
+	"path/filepath"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/fileutil"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// WriteFiles renders every export from config into its file. Relative paths
+// are inside the data dir.
+func WriteFiles(cfg *config.Config) {
+	for _, e := range cfg.Exports {
+		values, err := url.ParseQuery(e.Query)
+		if err != nil {
+			logger.LogError("[export] Invalid query '%s': %v", e.Query, err)
+			continue
+		}
+
+		filter, err := proxy.ParseFilter(values)
+		if err != nil {
+			logger.LogError("[export] %v", err)
+			continue
+		}
+
+		data, err := Render(e.Format, proxy.SelectWorking(filter).Proxies)
+		if err != nil {
+			logger.LogError("[export] Can't render '%s': %v", e.Path, err)
+			continue
+		}
+
+		path := e.Path
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(cfg.DataDir, path)
+		}
+
+		if err := fileutil.WriteAtomic(path, data, 0644); err != nil {
+			logger.LogError("[export] Can't write '%s': %v", path, err)
+			continue
+		}
+		logger.LogDebug("[export] written '%s'", path)
+	}
+}
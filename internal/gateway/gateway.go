@@ -0,0 +1,338 @@
+// Package gateway is an HTTP forward proxy and a SOCKS5 server that send every
+// request through a working proxy from the list and retry on another one if
+// it fails.
+package gateway
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync/atomic"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/lease"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/upstream"
+)
+
+var errNoUpstream = errors.New("No working upstream proxy available")
+
+type Gateway struct {
+	defaultRule    rule
+	rules          []rule
+	mode           string
+	retries        int
+	maxFailStreak  int
+	connectTimeout time.Duration
+	timeout        time.Duration
+	idleTimeout    time.Duration
+	banTtl         time.Duration
+	transports     transportCache
+	forward        *httputil.ReverseProxy
+	sessions       *sessions
+	sessionHeader  string
+}
+
+func New(cfg *config.Config) (*Gateway, error) {
+	filter, err := parseQuery(cfg.Gateway.Query)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid gateway query: %v", err)
+	}
+	rules, err := parseRules(cfg.Gateway.Rules, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	mode := cfg.Gateway.Mode
+	if mode == "" {
+		mode = proxy.PICK_UNIFORM
+	}
+	if !proxy.IsValidPickMode(mode) {
+		return nil, fmt.Errorf("Invalid gateway mode '%s'", mode)
+	}
+
+	g := &Gateway{
+		defaultRule:    rule{action: ACTION_PROXY, filter: filter},
+		rules:          rules,
+		mode:           mode,
+		retries:        cfg.Gateway.Retries,
+		maxFailStreak:  cfg.Gateway.MaxFailStreak,
+		connectTimeout: cfg.ConnectTimeoutDuration,
+		timeout:        cfg.Gateway.TimeoutDuration,
+		idleTimeout:    cfg.Gateway.IdleTimeoutDuration,
+		banTtl:         cfg.Gateway.BanTtlDuration,
+		sessions:       newSessions(cfg.Gateway.SessionTtlDuration),
+		sessionHeader:  cfg.Gateway.SessionHeader,
+	}
+	g.forward = &httputil.ReverseProxy{
+		// The outgoing request keeps the absolute URL of the incoming one,
+		// no X-Forwarded headers are added.
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.Header.Del(g.sessionHeader)
+		},
+		Transport: &retryTransport{g: g},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			logger.LogError("[gateway] %s %s failed: %v", r.Method, r.URL, err)
+			w.WriteHeader(http.StatusBadGateway)
+		},
+	}
+
+	return g, nil
+}
+
+// pick returns a working proxy passing the filter with the capability that
+// was not tried yet and is not reserved by leases, or nil if there are none
+// left. The proxy pinned to the
+// session comes first.
+func (g *Gateway) pick(filter *proxy.Filter, session string, tried map[string]bool, capability string) *proxy.Proxy {
+	f := *filter
+	f.Capabilities = append(append([]string(nil), filter.Capabilities...), capability)
+
+	reserved := lease.Reserved()
+	if p := g.pinned(&f, session, tried, reserved); p != nil {
+		return p
+	}
+
+	picked, _, err := proxy.PickWorkingExcept(f, g.mode, 1, func(key string) bool {
+		return tried[key] || reserved(key)
+	})
+	if err != nil || len(picked) == 0 {
+		return nil
+	}
+
+	tried[picked[0].Key()] = true
+	return &picked[0]
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// The HTTP front-end has no authentication, the username in
+	// Proxy-Authorization is whatever the client sends.
+	client := requestClient(r)
+	session := sessionKey(clientId("", r.RemoteAddr), g.requestSession(r))
+
+	if r.Method == http.MethodConnect {
+		g.handleConnect(w, r, session, client)
+		return
+	}
+
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a forward proxy, request an absolute URL", http.StatusBadRequest)
+		return
+	}
+	if g.route(r.URL.Host).action == ACTION_BLOCK {
+		recordRequest(protocolHttp, client, nil, resultBlocked, 0, 0)
+		http.Error(w, errBlocked.Error(), http.StatusForbidden)
+		return
+	}
+
+	ctx := withClient(withSession(r.Context(), session), client)
+	g.forward.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// connectCapability returns the capability an upstream needs to tunnel to
+// the address.
+func connectCapability(address string) string {
+	if _, port, err := net.SplitHostPort(address); err == nil && port == "443" {
+		return proxy.CAP_CONNECT_443
+	}
+	return proxy.CAP_CONNECT_ANY
+}
+
+// dialTunnel opens a tunnel to address through the first upstream that
+// accepts it, pins the session to that upstream and returns it along with the
+// connection. The gateway rules may send it directly, without an upstream, or
+// block it.
+func (g *Gateway) dialTunnel(ctx context.Context, address, session string) (net.Conn, *proxy.Proxy, error) {
+	route := g.route(address)
+	switch route.action {
+	case ACTION_BLOCK:
+		return nil, nil, errBlocked
+	case ACTION_DIRECT:
+		conn, err := (&net.Dialer{Timeout: g.connectTimeout}).DialContext(ctx, "tcp", address)
+		return conn, nil, err
+	}
+
+	capability := connectCapability(address)
+	filter := route.filter
+	filter.Domain = address
+	tried := make(map[string]bool)
+
+	for i := 0; i < g.retries && ctx.Err() == nil; i++ {
+		p := g.pick(&filter, session, tried, capability)
+		if p == nil {
+			break
+		}
+
+		start := time.Now()
+		conn, err := upstream.Dial(ctx, p, address, g.connectTimeout)
+		g.observe(ctx, p, err == nil, time.Since(start))
+		recordAttempt(p, err == nil)
+		if err != nil {
+			logger.LogDebug("[gateway] CONNECT %s through '%s' failed: %v", address, p.Key(), err)
+			continue
+		}
+		if session != "" {
+			g.sessions.pin(session, p.Key())
+		}
+		return conn, p, nil
+	}
+
+	if len(tried) == 0 {
+		return nil, nil, errNoUpstream
+	}
+	return nil, nil, fmt.Errorf("All %d upstreams failed", len(tried))
+}
+
+func (g *Gateway) handleConnect(w http.ResponseWriter, r *http.Request, session, client string) {
+	address := r.Host
+
+	upstreamConn, p, err := g.dialTunnel(r.Context(), address, session)
+	if err != nil {
+		recordRequest(protocolConnect, client, nil, failureResult(err), 0, 0)
+	}
+	if errors.Is(err, errBlocked) {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if err != nil {
+		logger.LogError("[gateway] CONNECT %s failed: %v", address, err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstreamConn.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		upstreamConn.Close()
+		logger.LogError("[gateway] Can't hijack connection: %v", err)
+		return
+	}
+
+	if _, err := clientConn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+		clientConn.Close()
+		upstreamConn.Close()
+		return
+	}
+
+	// The client may have sent the start of the tunnel data along with the
+	// CONNECT request.
+	buffered := int64(clientBuf.Reader.Buffered())
+	if buffered > 0 {
+		data, _ := clientBuf.Reader.Peek(int(buffered))
+		if _, err := upstreamConn.Write(data); err != nil {
+			clientConn.Close()
+			upstreamConn.Close()
+			return
+		}
+	}
+
+	bytesIn, bytesOut := pipe(clientConn, upstreamConn, g.idleTimeout)
+	recordRequest(protocolConnect, client, p, resultSuccess, bytesIn, bytesOut+buffered)
+}
+
+// readHeaderTimeout bounds the time a client may take to send the request
+// headers.
+const readHeaderTimeout = 10 * time.Second
+
+// idleConn fails a read or write after the tunnel has been idle for timeout.
+// Activity in either direction counts, so a long download doesn't time out
+// the silent upload side.
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+	active  *atomic.Int64
+}
+
+func (c *idleConn) idle() bool {
+	return time.Since(time.Unix(0, c.active.Load())) >= c.timeout
+}
+
+func (c *idleConn) Read(b []byte) (int, error) {
+	for {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+		n, err := c.Conn.Read(b)
+		if n > 0 {
+			c.active.Store(time.Now().UnixNano())
+		}
+		var netErr net.Error
+		if n == 0 && errors.As(err, &netErr) && netErr.Timeout() && !c.idle() {
+			continue
+		}
+		return n, err
+	}
+}
+
+func (c *idleConn) Write(b []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.active.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// pipe copies data both ways until one side is done or the tunnel is idle
+// for idleTimeout, then closes both. It returns the number of bytes copied
+// from b to a and from a to b.
+func pipe(a, b net.Conn, idleTimeout time.Duration) (int64, int64) {
+	active := &atomic.Int64{}
+	active.Store(time.Now().UnixNano())
+	ia := &idleConn{Conn: a, timeout: idleTimeout, active: active}
+	ib := &idleConn{Conn: b, timeout: idleTimeout, active: active}
+
+	var toA, toB int64
+	done := make(chan struct{}, 2)
+	go func() {
+		toA, _ = io.Copy(ia, ib)
+		done <- struct{}{}
+	}()
+	go func() {
+		toB, _ = io.Copy(ib, ia)
+		done <- struct{}{}
+	}()
+
+	<-done
+	a.Close()
+	b.Close()
+	<-done
+	return toA, toB
+}
+
+// Start serves the gateway on the configured address until ctx is
+// cancelled.
+func Start(ctx context.Context, cfg *config.Config) {
+	g, err := New(cfg)
+	if err != nil {
+		logger.LogError("[gateway] %v", err)
+		return
+	}
+
+	srv := &http.Server{
+		Addr:              cfg.Gateway.Listen,
+		Handler:           g,
+		ReadHeaderTimeout: readHeaderTimeout,
+		IdleTimeout:       cfg.Gateway.IdleTimeoutDuration,
+	}
+
+	go func() {
+		<-ctx.Done()
+		srv.Shutdown(context.Background())
+	}()
+
+	logger.LogInfo("Starting proxy gateway on %s", cfg.Gateway.Listen)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.LogError("[gateway] Failed to start: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package gateway
+
+import (
+	"context"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// observe feeds the outcome of a request through the upstream back into its
+// stats and score. An upstream that fails maxFailStreak requests in a row is
+// taken out of rotation at once and queued for a check, which puts it back if
+// it passes.
+func (g *Gateway) observe(ctx context.Context, p *proxy.Proxy, success bool, latency time.Duration) {
+	// The client went away, that says nothing about the upstream.
+	if !success && ctx.Err() != nil {
+		return
+	}
+
+	if success {
+		upstreamLatency.Observe(latency.Seconds())
+	}
+
+	pulled := false
+	_, ok := proxy.Modify(p.Key(), func(p *proxy.Proxy) {
+		p.RecordTraffic(success, latency)
+		if !success && p.IsWork && p.Traffic.FailStreak >= g.maxFailStreak {
+			p.IsWork = false
+			pulled = true
+		}
+	})
+	if !ok || !pulled {
+		return
+	}
+
+	pulledTotal.Inc()
+	logger.LogInfo("[gateway] Proxy '%s' failed %d requests in a row, taken out of rotation", p.Key(), g.maxFailStreak)
+	proxy.Recheck(p.Key())
+}
+
+// banDomain keeps the upstream away from a domain that refused it. The
+// upstream itself works, so its fail streak is left alone.
+func (g *Gateway) banDomain(p *proxy.Proxy, domain string) {
+	proxy.Modify(p.Key(), func(p *proxy.Proxy) {
+		p.BanDomain(domain, time.Now().Add(g.banTtl))
+	})
+	bannedTotal.Inc()
+	logger.LogDebug("[gateway] Proxy '%s' blocked by '%s', banned for %v", p.Key(), domain, g.banTtl)
+}
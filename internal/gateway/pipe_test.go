@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPipeClosesIdleTunnel(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	defer client.Close()
+	defer upstream.Close()
+
+	done := make(chan struct{})
+	go func() {
+		pipe(clientEnd, upstreamEnd, 100*time.Millisecond)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("idle tunnel not closed")
+	}
+}
+
+// TestPipeKeepsOneWayTraffic streams data from the upstream while the
+// client stays silent, the tunnel must stay open for the whole download.
+func TestPipeKeepsOneWayTraffic(t *testing.T) {
+	client, clientEnd := net.Pipe()
+	upstream, upstreamEnd := net.Pipe()
+	defer client.Close()
+
+	const chunks = 10
+	go func() {
+		defer upstream.Close()
+		for i := 0; i < chunks; i++ {
+			time.Sleep(30 * time.Millisecond)
+			if _, err := upstream.Write([]byte("x")); err != nil {
+				return
+			}
+		}
+	}()
+	go pipe(clientEnd, upstreamEnd, 100*time.Millisecond)
+
+	data, _ := io.ReadAll(client)
+	if len(data) != chunks {
+		t.Fatalf("client got %d bytes, want %d", len(data), chunks)
+	}
+}
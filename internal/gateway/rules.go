@@ -0,0 +1,111 @@
+package gateway
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+const (
+	ACTION_PROXY  = "proxy"
+	ACTION_DIRECT = "direct"
+	ACTION_BLOCK  = "block"
+)
+
+var errBlocked = errors.New("Destination is blocked by the gateway rules")
+
+// rule sends requests to the hosts matching one of its patterns through the
+// proxies passing its filter, directly, or blocks them.
+type rule struct {
+	patterns []string
+	action   string
+	filter   proxy.Filter
+}
+
+// parseQuery turns a query string like the one of the proxies API into a
+// filter.
+func parseQuery(query string) (proxy.Filter, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return proxy.Filter{}, fmt.Errorf("Invalid query '%s': %v", query, err)
+	}
+	return proxy.ParseFilter(values)
+}
+
+// parseRules checks the configured rules. A rule without a query uses the
+// default filter of the gateway.
+func parseRules(configs []config.GatewayRuleConfig, defaultFilter proxy.Filter) ([]rule, error) {
+	rules := make([]rule, 0, len(configs))
+
+	for i, c := range configs {
+		if len(c.Hosts) == 0 {
+			return nil, fmt.Errorf("Gateway rule %d has no hosts", i+1)
+		}
+
+		r := rule{action: c.Action, filter: defaultFilter}
+		if r.action == "" {
+			r.action = ACTION_PROXY
+		}
+		switch r.action {
+		case ACTION_PROXY:
+			if c.Query != "" {
+				filter, err := parseQuery(c.Query)
+				if err != nil {
+					return nil, fmt.Errorf("Gateway rule %d: %v", i+1, err)
+				}
+				r.filter = filter
+			}
+		case ACTION_DIRECT, ACTION_BLOCK:
+		default:
+			return nil, fmt.Errorf("Invalid action '%s' in gateway rule %d", c.Action, i+1)
+		}
+
+		for _, pattern := range c.Hosts {
+			pattern = strings.ToLower(strings.TrimSpace(pattern))
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("Invalid host pattern '%s' in gateway rule %d", pattern, i+1)
+			}
+			r.patterns = append(r.patterns, pattern)
+		}
+
+		rules = append(rules, r)
+	}
+
+	return rules, nil
+}
+
+// matchHost reports whether the host matches the pattern. "*.example.com"
+// matches every subdomain of example.com but not example.com itself, other
+// patterns use path.Match syntax.
+func matchHost(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok && !strings.ContainsAny(suffix, "*?[") {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	ok, _ := path.Match(pattern, host)
+	return ok
+}
+
+// route returns the first rule matching the host of address, which may have
+// a port, or the default rule.
+func (g *Gateway) route(address string) *rule {
+	host := address
+	if h, _, err := net.SplitHostPort(address); err == nil {
+		host = h
+	}
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+
+	for i := range g.rules {
+		for _, pattern := range g.rules[i].patterns {
+			if matchHost(pattern, host) {
+				return &g.rules[i]
+			}
+		}
+	}
+	return &g.defaultRule
+}
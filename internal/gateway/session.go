@@ -0,0 +1,149 @@
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// sessionSeparator splits the proxy username into the user and the session
+// id, e.g. "user-session-abc".
+const sessionSeparator = "session-"
+
+// sessions pins session ids to upstream proxies. Pins expire after ttl
+// without use.
+type sessions struct {
+	mtx       sync.Mutex
+	ttl       time.Duration
+	pins      map[string]*pin
+	lastSweep time.Time
+}
+
+type pin struct {
+	key       string
+	expiresAt time.Time
+}
+
+func newSessions(ttl time.Duration) *sessions {
+	return &sessions{
+		ttl:  ttl,
+		pins: make(map[string]*pin),
+	}
+}
+
+// get returns the proxy key pinned to the session and extends the pin.
+func (s *sessions) get(session string) (string, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	p, ok := s.pins[session]
+	if !ok || now.After(p.expiresAt) {
+		return "", false
+	}
+	p.expiresAt = now.Add(s.ttl)
+	return p.key, true
+}
+
+func (s *sessions) pin(session, key string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	now := time.Now()
+	if now.Sub(s.lastSweep) > s.ttl {
+		for id, p := range s.pins {
+			if now.After(p.expiresAt) {
+				delete(s.pins, id)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	s.pins[session] = &pin{key: key, expiresAt: now.Add(s.ttl)}
+}
+
+// splitUsername returns the user and the session id of a proxy username.
+// "user-session-abc" gives "user" and "abc", "session-abc" gives "" and
+// "abc", a username without a session is returned as is.
+func splitUsername(username string) (string, string) {
+	if strings.HasPrefix(username, sessionSeparator) {
+		return "", strings.TrimPrefix(username, sessionSeparator)
+	}
+	if i := strings.LastIndex(username, "-"+sessionSeparator); i >= 0 {
+		return username[:i], username[i+len(sessionSeparator)+1:]
+	}
+	return username, ""
+}
+
+// proxyUsername returns the username from the Proxy-Authorization header of
+// an HTTP gateway request.
+func proxyUsername(r *http.Request) string {
+	auth, ok := strings.CutPrefix(r.Header.Get("Proxy-Authorization"), "Basic ")
+	if !ok {
+		return ""
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth)
+	if err != nil {
+		return ""
+	}
+	username, _, _ := strings.Cut(string(decoded), ":")
+	return username
+}
+
+// requestSession returns the session id of an HTTP gateway request, from the
+// session header or from the Proxy-Authorization username.
+func (g *Gateway) requestSession(r *http.Request) string {
+	if session := r.Header.Get(g.sessionHeader); session != "" {
+		return session
+	}
+
+	_, session := splitUsername(proxyUsername(r))
+	return session
+}
+
+// sessionKey scopes a session id to its owner, the authenticated user or
+// else the client address, so clients picking the same id don't share or
+// re-pin each other's upstream.
+func sessionKey(owner, session string) string {
+	if session == "" {
+		return ""
+	}
+	return owner + "/" + session
+}
+
+type sessionContextKey struct{}
+
+func withSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionContextKey{}, session)
+}
+
+func sessionFrom(ctx context.Context) string {
+	session, _ := ctx.Value(sessionContextKey{}).(string)
+	return session
+}
+
+// pinned returns the live proxy pinned to the session if it still passes the
+// filter, was not tried yet and is not reserved by leases.
+func (g *Gateway) pinned(filter *proxy.Filter, session string, tried map[string]bool, reserved func(key string) bool) *proxy.Proxy {
+	if session == "" {
+		return nil
+	}
+
+	key, ok := g.sessions.get(session)
+	if !ok || tried[key] || reserved(key) {
+		return nil
+	}
+
+	p, ok := proxy.Get(key)
+	if !ok || !p.IsWork || p.IsTampered || !filter.Matches(&p) {
+		return nil
+	}
+
+	tried[key] = true
+	return &p
+}
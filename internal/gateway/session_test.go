@@ -0,0 +1,45 @@
+package gateway
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+func TestSessionsBelongToClients(t *testing.T) {
+	upstreams := []proxy.Proxy{fakeUpstream(t, http.StatusOK), fakeUpstream(t, http.StatusOK)}
+	g := newTestGateway(t, upstreams...)
+
+	request := func(remoteAddr string) {
+		r := httptest.NewRequest(http.MethodGet, "http://example.test/", nil)
+		r.RemoteAddr = remoteAddr
+		r.Header.Set(g.sessionHeader, "abc")
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d", w.Code)
+		}
+	}
+
+	request("192.0.2.1:1000")
+	first, ok := g.sessions.get(sessionKey("192.0.2.1", "abc"))
+	if !ok {
+		t.Fatal("session of the first client not pinned")
+	}
+
+	// Another client with the same id gets a session of its own, moving it
+	// leaves the first one alone.
+	request("192.0.2.2:2000")
+	if len(g.sessions.pins) != 2 {
+		t.Fatalf("%d sessions, want one per client", len(g.sessions.pins))
+	}
+	g.sessions.pin(sessionKey("192.0.2.2", "abc"), "moved")
+
+	// A new connection of the first client keeps its upstream.
+	request("192.0.2.1:1001")
+	if key, _ := g.sessions.get(sessionKey("192.0.2.1", "abc")); key != first {
+		t.Errorf("session moved from '%s' to '%s'", first, key)
+	}
+}
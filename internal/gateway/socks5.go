@@ -0,0 +1,258 @@
+package gateway
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/upstream"
+)
+
+// socks5Server accepts SOCKS5 CONNECT requests and tunnels them through the
+// gateway upstreams. Only username/password auth (RFC 1929) is supported
+// besides no auth.
+type socks5Server struct {
+	g        *Gateway
+	username string
+	password string
+}
+
+// socks5Request is what the client asked for in the handshake.
+type socks5Request struct {
+	address string
+	user    string
+	session string
+}
+
+// handshake reads the greeting, authenticates the client and returns the
+// address it wants to connect to with the user and the session id from the
+// username.
+func (s *socks5Server) handshake(conn net.Conn, reader *bufio.Reader) (socks5Request, error) {
+	var req socks5Request
+
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return req, err
+	}
+	if header[0] != upstream.SOCKS5_VERSION {
+		return req, fmt.Errorf("Unsupported version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return req, err
+	}
+
+	// Without configured credentials the username is still read when the
+	// client offers it, it may carry a session id.
+	method := byte(upstream.SOCKS5_AUTH_NONE)
+	if s.username != "" || containsByte(methods, upstream.SOCKS5_AUTH_PASSWORD) {
+		method = upstream.SOCKS5_AUTH_PASSWORD
+	}
+	if !containsByte(methods, method) {
+		conn.Write([]byte{upstream.SOCKS5_VERSION, upstream.SOCKS5_AUTH_NO_MATCH})
+		return req, fmt.Errorf("No acceptable auth method in %v", methods)
+	}
+	if _, err := conn.Write([]byte{upstream.SOCKS5_VERSION, method}); err != nil {
+		return req, err
+	}
+
+	if method == upstream.SOCKS5_AUTH_PASSWORD {
+		var err error
+		req.user, req.session, err = s.authenticate(conn, reader)
+		if err != nil {
+			return req, err
+		}
+	}
+
+	var request [3]byte
+	if _, err := io.ReadFull(reader, request[:]); err != nil {
+		return req, err
+	}
+	address, err := upstream.ReadSocks5Address(reader)
+	if errors.Is(err, upstream.ErrSocks5AddressType) {
+		writeSocks5Reply(conn, upstream.SOCKS5_REP_ADDRESS_UNSUPPORTED)
+	}
+	if err != nil {
+		return req, err
+	}
+	if request[1] != upstream.SOCKS5_CMD_CONNECT {
+		writeSocks5Reply(conn, upstream.SOCKS5_REP_COMMAND_UNSUPPORTED)
+		return req, fmt.Errorf("Unsupported command %d", request[1])
+	}
+
+	req.address = address
+	return req, nil
+}
+
+// authenticate checks the username without its session part and the
+// password, and returns the user and the session id.
+func (s *socks5Server) authenticate(conn net.Conn, reader *bufio.Reader) (string, string, error) {
+	readField := func() ([]byte, error) {
+		var length [1]byte
+		if _, err := io.ReadFull(reader, length[:]); err != nil {
+			return nil, err
+		}
+		field := make([]byte, length[0])
+		_, err := io.ReadFull(reader, field)
+		return field, err
+	}
+
+	var version [1]byte
+	if _, err := io.ReadFull(reader, version[:]); err != nil {
+		return "", "", err
+	}
+	username, err := readField()
+	if err != nil {
+		return "", "", err
+	}
+	password, err := readField()
+	if err != nil {
+		return "", "", err
+	}
+
+	user, session := splitUsername(string(username))
+	if s.username != "" {
+		usernameOk := subtle.ConstantTimeCompare([]byte(user), []byte(s.username)) == 1
+		passwordOk := subtle.ConstantTimeCompare(password, []byte(s.password)) == 1
+		if !usernameOk || !passwordOk {
+			conn.Write([]byte{upstream.SOCKS5_PASSWORD_VERSION, upstream.SOCKS5_PASSWORD_FAILURE})
+			return "", "", fmt.Errorf("Invalid credentials for '%s'", user)
+		}
+	}
+
+	_, err = conn.Write([]byte{upstream.SOCKS5_PASSWORD_VERSION, upstream.SOCKS5_PASSWORD_SUCCESS})
+	return user, session, err
+}
+
+func containsByte(list []byte, b byte) bool {
+	for _, item := range list {
+		if item == b {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSocks5Reply answers a request. The bound address is always reported
+// as 0.0.0.0:0, clients don't use it for CONNECT.
+func writeSocks5Reply(conn net.Conn, rep byte) error {
+	_, err := conn.Write([]byte{upstream.SOCKS5_VERSION, rep, 0, upstream.SOCKS5_ATYP_IPV4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+func (s *socks5Server) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(s.g.connectTimeout))
+	reader := bufio.NewReader(conn)
+
+	req, err := s.handshake(conn, reader)
+	if err != nil {
+		logger.LogDebug("[gateway] SOCKS5 handshake with %s failed: %v", conn.RemoteAddr(), err)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	client := clientId(req.user, conn.RemoteAddr().String())
+	address := req.address
+
+	// Without configured credentials any username is accepted, so it
+	// can't own a session.
+	owner := clientId("", conn.RemoteAddr().String())
+	if s.username != "" {
+		owner = req.user
+	}
+	session := sessionKey(owner, req.session)
+
+	upstreamConn, p, err := s.g.dialTunnel(ctx, address, session)
+	if err != nil {
+		recordRequest(protocolSocks5, client, nil, failureResult(err), 0, 0)
+	}
+	if errors.Is(err, errBlocked) {
+		logger.LogDebug("[gateway] SOCKS5 connect to %s blocked", address)
+		writeSocks5Reply(conn, upstream.SOCKS5_REP_NOT_ALLOWED)
+		return
+	}
+	if err != nil {
+		logger.LogError("[gateway] SOCKS5 connect to %s failed: %v", address, err)
+		writeSocks5Reply(conn, upstream.SOCKS5_REP_GENERAL_FAILURE)
+		return
+	}
+
+	if err := writeSocks5Reply(conn, upstream.SOCKS5_REP_SUCCESS); err != nil {
+		upstreamConn.Close()
+		return
+	}
+
+	// Data the client sent right after the request is already buffered.
+	buffered := int64(reader.Buffered())
+	if buffered > 0 {
+		data, _ := reader.Peek(int(buffered))
+		if _, err := upstreamConn.Write(data); err != nil {
+			upstreamConn.Close()
+			return
+		}
+	}
+
+	bytesIn, bytesOut := pipe(conn, upstreamConn, s.g.idleTimeout)
+	recordRequest(protocolSocks5, client, p, resultSuccess, bytesIn, bytesOut+buffered)
+}
+
+// StartSocks5 serves the SOCKS5 front-end until ctx is cancelled.
+func StartSocks5(ctx context.Context, cfg *config.Config) {
+	g, err := New(cfg)
+	if err != nil {
+		logger.LogError("[gateway] %v", err)
+		return
+	}
+
+	s := &socks5Server{
+		g:        g,
+		username: cfg.Gateway.Socks5.Username,
+		password: cfg.Gateway.Socks5.Password,
+	}
+
+	listener, err := net.Listen("tcp", cfg.Gateway.Socks5.Listen)
+	if err != nil {
+		logger.LogError("[gateway] Failed to start SOCKS5: %v", err)
+		return
+	}
+
+	// Without credentials anyone who can connect may use the pool, so that
+	// is only allowed on a loopback address.
+	if addr, ok := listener.Addr().(*net.TCPAddr); ok && !addr.IP.IsLoopback() && s.username == "" {
+		listener.Close()
+		logger.LogError("[gateway] Refusing to serve SOCKS5 on %s without a username and password, set gateway.socks5.username or listen on 127.0.0.1",
+			cfg.Gateway.Socks5.Listen)
+		return
+	}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	logger.LogInfo("Starting SOCKS5 gateway on %s", cfg.Gateway.Socks5.Listen)
+	for {
+		conn, err := listener.Accept()
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			logger.LogError("[gateway] SOCKS5 accept failed: %v", err)
+			time.Sleep(100 * time.Millisecond)
+			continue
+		}
+		go s.serve(ctx, conn)
+	}
+}
@@ -0,0 +1,211 @@
+package gateway
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/upstream"
+)
+
+const (
+	// Request bodies up to this size are buffered so the request can be
+	// retried on another upstream, larger ones are sent once.
+	maxReplayBody = 1024 * 1024
+
+	maxCachedTransports = 1024
+)
+
+// transportCache keeps one transport per upstream so its connections are
+// reused between requests.
+type transportCache struct {
+	mtx    sync.Mutex
+	byKey  map[string]*http.Transport
+	direct *http.Transport
+}
+
+// directTransport returns the transport for requests the gateway rules send
+// without an upstream.
+func (g *Gateway) directTransport() *http.Transport {
+	c := &g.transports
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.direct == nil {
+		c.direct = &http.Transport{
+			DialContext:           (&net.Dialer{Timeout: g.connectTimeout}).DialContext,
+			ResponseHeaderTimeout: g.timeout,
+		}
+	}
+	return c.direct
+}
+
+func (g *Gateway) transport(p *proxy.Proxy) *http.Transport {
+	c := &g.transports
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := p.Key()
+	if t, ok := c.byKey[key]; ok {
+		return t
+	}
+
+	// The list of upstreams changes with every check cycle, old transports
+	// are dropped all at once instead of tracking their use.
+	if c.byKey == nil || len(c.byKey) >= maxCachedTransports {
+		for _, t := range c.byKey {
+			t.CloseIdleConnections()
+		}
+		c.byKey = make(map[string]*http.Transport)
+	}
+
+	t := &http.Transport{
+		TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
+		TLSHandshakeTimeout:   g.connectTimeout,
+		ResponseHeaderTimeout: g.timeout,
+		MaxIdleConnsPerHost:   4,
+	}
+	upstream.SetupTransport(t, p, g.connectTimeout)
+	c.byKey[key] = t
+	return t
+}
+
+// retryTransport sends the request through an upstream and moves on to the
+// next one when it can't be reached or rejects the request.
+type retryTransport struct {
+	g *Gateway
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	client := clientFrom(req.Context())
+
+	route := t.g.route(req.URL.Host)
+	switch route.action {
+	case ACTION_BLOCK:
+		recordRequest(protocolHttp, client, nil, resultBlocked, 0, 0)
+		return nil, errBlocked
+	case ACTION_DIRECT:
+		resp, err := t.g.directTransport().RoundTrip(req)
+		if err != nil {
+			recordRequest(protocolHttp, client, nil, resultError, 0, 0)
+			return nil, err
+		}
+		return countedResponse(req, client, nil, resp), nil
+	}
+
+	attempts := t.g.retries
+
+	var body []byte
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.ContentLength < 0 || req.ContentLength > maxReplayBody {
+			attempts = 1
+		} else {
+			var err error
+			body, err = io.ReadAll(req.Body)
+			req.Body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("Can't read request body: %v", err)
+			}
+		}
+	}
+
+	session := sessionFrom(req.Context())
+	filter := route.filter
+	filter.Domain = req.URL.Host
+	tried := make(map[string]bool)
+	lastErr := errNoUpstream
+	// The last response of a target refusing the upstreams, returned if no
+	// other upstream gets through.
+	var blocked *http.Response
+	var blockedBy *proxy.Proxy
+	// The last response of an upstream failing the request, returned if no
+	// upstream gets through and the target refused none.
+	var failed *http.Response
+	var failedBy *proxy.Proxy
+	closeFallbacks := func() {
+		for _, resp := range []*http.Response{blocked, failed} {
+			if resp != nil {
+				resp.Body.Close()
+			}
+		}
+	}
+
+	for i := 0; i < attempts && req.Context().Err() == nil; i++ {
+		p := t.g.pick(&filter, session, tried, proxy.CAP_HTTP_FORWARD)
+		if p == nil {
+			break
+		}
+
+		outreq := req
+		if body != nil {
+			outreq = req.Clone(req.Context())
+			outreq.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		start := time.Now()
+		resp, err := t.g.transport(p).RoundTrip(outreq)
+		success := err == nil && !proxy.IsFailureStatus(resp.StatusCode)
+		t.g.observe(req.Context(), p, success, time.Since(start))
+		recordAttempt(p, success)
+
+		switch {
+		case err == nil && proxy.IsBlockedStatus(resp.StatusCode):
+			t.g.banDomain(p, req.URL.Host)
+			if blocked != nil {
+				blocked.Body.Close()
+			}
+			blocked, blockedBy = resp, p
+			continue
+		case success:
+			closeFallbacks()
+			if session != "" {
+				t.g.sessions.pin(session, p.Key())
+			}
+			return countedResponse(req, client, p, resp), nil
+		case err == nil && resp.StatusCode == http.StatusProxyAuthRequired:
+			// Passing it on would ask the client for credentials of the
+			// gateway.
+			resp.Body.Close()
+			err = fmt.Errorf("Upstream requires authentication")
+		case err == nil:
+			if failed != nil {
+				failed.Body.Close()
+			}
+			failed, failedBy = resp, p
+			err = fmt.Errorf("Upstream failed with status %d", resp.StatusCode)
+		}
+
+		logger.LogDebug("[gateway] %s %s through '%s' failed: %v", req.Method, req.URL, p.Key(), err)
+		lastErr = err
+	}
+
+	switch {
+	case blocked != nil:
+		if failed != nil {
+			failed.Body.Close()
+		}
+		return countedResponse(req, client, blockedBy, blocked), nil
+	case failed != nil:
+		return countedResponse(req, client, failedBy, failed), nil
+	}
+
+	recordRequest(protocolHttp, client, nil, resultError, 0, 0)
+	return nil, lastErr
+}
+
+// countedResponse counts the client request and its traffic once the
+// response body is closed.
+func countedResponse(req *http.Request, client string, p *proxy.Proxy, resp *http.Response) *http.Response {
+	bytesOut := max(req.ContentLength, 0)
+	resp.Body = &countingBody{ReadCloser: resp.Body, done: func(n int64) {
+		recordRequest(protocolHttp, client, p, resultSuccess, n, bytesOut)
+	}}
+	return resp
+}
@@ -0,0 +1,143 @@
+package gateway
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// fakeUpstream is an HTTP proxy answering every request with status.
+func fakeUpstream(t *testing.T, status int) proxy.Proxy {
+	t.Helper()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+
+	host, port, _ := net.SplitHostPort(srv.Listener.Addr().String())
+	p := proxy.Proxy{
+		Ip:           host,
+		Port:         port,
+		Protocol:     proxy.PROTO_HTTP,
+		IsWork:       true,
+		Capabilities: []string{proxy.CAP_HTTP_FORWARD},
+	}
+	return p
+}
+
+func newTestGateway(t *testing.T, upstreams ...proxy.Proxy) *Gateway {
+	t.Helper()
+
+	for _, p := range proxy.SelectAll(proxy.Filter{}).Proxies {
+		proxy.Delete(p)
+	}
+	proxy.AddList(upstreams)
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	text := "parse_period: 1h\ncheck_period: 1h\ngateway:\n  retries: 3\n  max_fail_streak: 3\n"
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+
+	g, err := New(config.GetConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+func get(g *Gateway, url string) int {
+	w := httptest.NewRecorder()
+	g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, url, nil))
+	return w.Code
+}
+
+// TestBlockedStatusBansDomain checks that a target refusing the upstreams
+// bans them for its domain only and leaves their fail streak alone.
+func TestBlockedStatusBansDomain(t *testing.T) {
+	upstreams := []proxy.Proxy{fakeUpstream(t, http.StatusForbidden), fakeUpstream(t, http.StatusTooManyRequests)}
+	g := newTestGateway(t, upstreams...)
+
+	if code := get(g, "http://blocked.example/"); code != http.StatusForbidden && code != http.StatusTooManyRequests {
+		t.Fatalf("got status %d, want the refusal of the target", code)
+	}
+
+	for _, u := range upstreams {
+		p, ok := proxy.Get(u.Key())
+		if !ok {
+			t.Fatalf("proxy '%s' gone", u.Key())
+		}
+		if !p.IsBannedFor("blocked.example", time.Now()) {
+			t.Errorf("proxy '%s' not banned for the domain", p.Key())
+		}
+		if p.Traffic.FailStreak != 0 || !p.IsWork {
+			t.Errorf("proxy '%s' has fail streak %d, working %v", p.Key(), p.Traffic.FailStreak, p.IsWork)
+		}
+	}
+
+	// Every upstream is banned for the domain now, other domains still get
+	// through.
+	if code := get(g, "http://blocked.example/"); code != http.StatusBadGateway {
+		t.Errorf("banned domain got status %d, want %d", code, http.StatusBadGateway)
+	}
+	if code := get(g, "http://other.example/"); code == http.StatusBadGateway {
+		t.Errorf("other domain got status %d", code)
+	}
+}
+
+func TestBadGatewayCountsAsFailure(t *testing.T) {
+	upstream := fakeUpstream(t, http.StatusBadGateway)
+	g := newTestGateway(t, upstream)
+
+	get(g, "http://example.test/")
+
+	p, _ := proxy.Get(upstream.Key())
+	if p.Traffic.FailStreak != 1 {
+		t.Errorf("fail streak %d, want 1", p.Traffic.FailStreak)
+	}
+}
+
+func TestTargetErrorIsNotUpstreamFailure(t *testing.T) {
+	upstream := fakeUpstream(t, http.StatusServiceUnavailable)
+	g := newTestGateway(t, upstream)
+
+	if code := get(g, "http://example.test/"); code != http.StatusServiceUnavailable {
+		t.Fatalf("got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+
+	p, _ := proxy.Get(upstream.Key())
+	if p.Traffic.FailStreak != 0 || p.Traffic.SuccessCount != 1 {
+		t.Errorf("fail streak %d, successes %d", p.Traffic.FailStreak, p.Traffic.SuccessCount)
+	}
+}
+
+// TestFailedUpstreamIsRetried checks that a 502 from an upstream doesn't
+// reach the client while another upstream gets through.
+func TestFailedUpstreamIsRetried(t *testing.T) {
+	bad := fakeUpstream(t, http.StatusBadGateway)
+	good := fakeUpstream(t, http.StatusOK)
+	g := newTestGateway(t, bad, good)
+
+	// Upstreams are picked at random, repeat until the failing one was
+	// tried.
+	for i := 0; i < 50; i++ {
+		if code := get(g, "http://example.test/"); code != http.StatusOK {
+			t.Fatalf("request %d got status %d, want %d", i, code, http.StatusOK)
+		}
+		if p, _ := proxy.Get(bad.Key()); p.Traffic.FailsCount > 0 {
+			return
+		}
+	}
+	t.Fatal("the failing upstream was never tried")
+}
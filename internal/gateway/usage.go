@@ -0,0 +1,129 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/usage"
+)
+
+// clientId names the client in the usage stats: the proxy username without
+// its session part, or the IP address of the client without credentials.
+func clientId(user string, remoteAddr string) string {
+	if user != "" {
+		return user
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+func requestClient(r *http.Request) string {
+	user, _ := splitUsername(proxyUsername(r))
+	return clientId(user, r.RemoteAddr)
+}
+
+type clientContextKey struct{}
+
+func withClient(ctx context.Context, client string) context.Context {
+	return context.WithValue(ctx, clientContextKey{}, client)
+}
+
+func clientFrom(ctx context.Context) string {
+	client, _ := ctx.Value(clientContextKey{}).(string)
+	return client
+}
+
+// Protocols and results of client requests in the metrics.
+const (
+	protocolHttp    = "http"
+	protocolConnect = "connect"
+	protocolSocks5  = "socks5"
+
+	resultSuccess = "success"
+	resultError   = "error"
+	resultBlocked = "blocked"
+)
+
+var (
+	requestsTotal = metrics.NewCounterVec("ppc_gateway_requests_total",
+		"Gateway client requests and tunnels by protocol and result.", "protocol", "result")
+	attemptsTotal = metrics.NewCounterVec("ppc_gateway_upstream_attempts_total",
+		"Requests and tunnels sent to upstreams by result, retries included.", "result")
+	bytesTotal = metrics.NewCounterVec("ppc_gateway_bytes_total",
+		"Gateway traffic from (in) and to (out) the targets.", "direction")
+	upstreamLatency = metrics.NewHistogramVec("ppc_gateway_upstream_latency_seconds",
+		"Time to the response headers or the open tunnel of successful upstream attempts.", metrics.DurationBuckets)
+	pulledTotal = metrics.NewCounterVec("ppc_gateway_upstreams_pulled_total",
+		"Upstreams taken out of rotation after failing in a row.")
+	bannedTotal = metrics.NewCounterVec("ppc_gateway_domain_bans_total",
+		"Upstreams banned for a domain after the target refused them with 403 or 429.")
+)
+
+func failureResult(err error) string {
+	if errors.Is(err, errBlocked) {
+		return resultBlocked
+	}
+	return resultError
+}
+
+// recordAttempt counts a request sent through the upstream.
+func recordAttempt(p *proxy.Proxy, success bool) {
+	c := usage.Counters{Requests: 1}
+	if !success {
+		c.Errors = 1
+		attemptsTotal.Inc("failure")
+	} else {
+		attemptsTotal.Inc("success")
+	}
+	usage.Record(usage.KIND_PROXY, p.Key(), c)
+}
+
+// recordRequest counts a client request and its traffic, and adds the traffic
+// to the upstream that carried it if there was one.
+func recordRequest(protocol, client string, p *proxy.Proxy, result string, bytesIn, bytesOut int64) {
+	requestsTotal.Inc(protocol, result)
+	bytesTotal.Add(float64(bytesIn), "in")
+	bytesTotal.Add(float64(bytesOut), "out")
+
+	c := usage.Counters{Requests: 1, BytesIn: bytesIn, BytesOut: bytesOut}
+	if result != resultSuccess {
+		c.Errors = 1
+	}
+	usage.Record(usage.KIND_CLIENT, client, c)
+
+	if p != nil && (bytesIn > 0 || bytesOut > 0) {
+		usage.Record(usage.KIND_PROXY, p.Key(), usage.Counters{BytesIn: bytesIn, BytesOut: bytesOut})
+	}
+}
+
+// countingBody counts the bytes of a response body read by the client and
+// reports them once on Close.
+type countingBody struct {
+	io.ReadCloser
+	n    int64
+	once sync.Once
+	done func(n int64)
+}
+
+func (b *countingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.n += int64(n)
+	return n, err
+}
+
+func (b *countingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(func() {
+		b.done(b.n)
+	})
+	return err
+}
@@ -0,0 +1,292 @@
+package lease
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/usage"
+)
+
+var (
+	ErrNotFound    = errors.New("Lease not found")
+	ErrUnavailable = errors.New("No working proxies available for leasing")
+)
+
+type Lease struct {
+	Id        string      `json:"id"`
+	Proxy     proxy.Proxy `json:"proxy"`
+	Client    string      `json:"client"`
+	CreatedAt time.Time   `json:"created_at"`
+	ExpiresAt time.Time   `json:"expires_at"`
+}
+
+// MarshalJSON shows the leased proxy in its redacted form.
+func (l Lease) MarshalJSON() ([]byte, error) {
+	type lease Lease
+	return json.Marshal(struct {
+		lease
+		Proxy proxy.View `json:"proxy"`
+	}{lease(l), l.Proxy.View()})
+}
+
+// Feedback is what the client reports when it releases a lease. Outcome is
+// "success", "failure" or empty, every status code counts as one more
+// outcome.
+type Feedback struct {
+	Outcome     string `json:"outcome"`
+	StatusCodes []int  `json:"status_codes"`
+}
+
+// Leases live in memory only, after a restart all proxies are free again.
+var (
+	mtx     sync.Mutex
+	leases  = make(map[string]*Lease)
+	byProxy = make(map[string]int)
+)
+
+var (
+	acquisitionsTotal = metrics.NewCounterVec("ppc_lease_acquisitions_total",
+		"Lease requests by result.", "result")
+	releasesTotal = metrics.NewCounterVec("ppc_lease_releases_total",
+		"Released leases by reported outcome, none without feedback.", "outcome")
+	expiredTotal = metrics.NewCounterVec("ppc_leases_expired_total",
+		"Leases dropped after their TTL.")
+)
+
+func init() {
+	// The scrape only reads, expired leases are left for the next lease
+	// call to drop and count.
+	metrics.NewGaugeFunc("ppc_leases_active", "Active leases.", nil,
+		func(emit func(v float64, values ...string)) {
+			mtx.Lock()
+			defer mtx.Unlock()
+
+			now := time.Now()
+			active := 0
+			for _, l := range leases {
+				if !now.After(l.ExpiresAt) {
+					active++
+				}
+			}
+			emit(float64(active))
+		})
+}
+
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// clampTtl applies the configured default and maximum to the requested TTL.
+func clampTtl(ttl time.Duration) time.Duration {
+	cfg := &config.GetConfig().Leases
+	if ttl <= 0 {
+		return cfg.DefaultTtlDuration
+	}
+	return min(ttl, cfg.MaxTtlDuration)
+}
+
+// expire drops the leases past their TTL. It must be called under mtx.
+func expire(now time.Time) {
+	for id, l := range leases {
+		if now.After(l.ExpiresAt) {
+			logger.LogDebug("[lease] lease '%s' of '%s' expired", id, l.Proxy.Key())
+			remove(l)
+			expiredTotal.Inc()
+		}
+	}
+}
+
+func remove(l *Lease) {
+	delete(leases, l.Id)
+	key := l.Proxy.Key()
+	if byProxy[key]--; byProxy[key] <= 0 {
+		delete(byProxy, key)
+	}
+}
+
+// acquireTries bounds the picks of Acquire when other clients lease the
+// picked proxies first.
+const acquireTries = 3
+
+// Acquire leases a working proxy matching the filter that has less than
+// max_per_proxy active leases to the client. The proxy is picked without
+// holding the lease lock and checked again under it before it is leased.
+func Acquire(f proxy.Filter, mode string, ttl time.Duration, client string) (Lease, error) {
+	maxPerProxy := config.GetConfig().Leases.MaxPerProxy
+
+	var l *Lease
+	var err error
+	rejected := make(map[string]bool)
+	for try := 0; try < acquireTries && l == nil && err == nil; try++ {
+		full := Reserved()
+
+		var picked []proxy.Proxy
+		picked, _, err = proxy.PickWorkingExcept(f, mode, 1, func(key string) bool {
+			return full(key) || rejected[key]
+		})
+		if err != nil || len(picked) == 0 {
+			break
+		}
+
+		key := picked[0].Key()
+		mtx.Lock()
+		now := time.Now()
+		expire(now)
+		if byProxy[key] < maxPerProxy {
+			l = &Lease{
+				Id:        newId(),
+				Proxy:     picked[0],
+				Client:    client,
+				CreatedAt: now,
+				ExpiresAt: now.Add(clampTtl(ttl)),
+			}
+			leases[l.Id] = l
+			byProxy[key]++
+		}
+		mtx.Unlock()
+		rejected[key] = true
+	}
+
+	if err == nil && l == nil {
+		err = ErrUnavailable
+	}
+	if errors.Is(err, ErrUnavailable) {
+		acquisitionsTotal.Inc("unavailable")
+	}
+	if err != nil {
+		usage.Record(usage.KIND_CLIENT, client, usage.Counters{Requests: 1, Errors: 1})
+		return Lease{}, err
+	}
+	acquisitionsTotal.Inc("success")
+
+	usage.Record(usage.KIND_CLIENT, client, usage.Counters{Requests: 1})
+	usage.Record(usage.KIND_PROXY, l.Proxy.Key(), usage.Counters{Requests: 1})
+
+	logger.LogDebug("[lease] proxy '%s' leased as '%s' until %v", l.Proxy.Key(), l.Id, l.ExpiresAt)
+	return *l, nil
+}
+
+// Reserved returns a snapshot of the proxies leased max_per_proxy times.
+// Everything that hands out proxies skips them, so a lease is exclusive
+// against the gateway and the random pick endpoint as well.
+func Reserved() func(key string) bool {
+	maxPerProxy := config.GetConfig().Leases.MaxPerProxy
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	expire(time.Now())
+
+	full := make(map[string]bool)
+	for key, n := range byProxy {
+		if n >= maxPerProxy {
+			full[key] = true
+		}
+	}
+	return func(key string) bool {
+		return full[key]
+	}
+}
+
+// Heartbeat extends the lease by ttl from now.
+func Heartbeat(id string, ttl time.Duration) (Lease, error) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	now := time.Now()
+	expire(now)
+
+	l, ok := leases[id]
+	if !ok {
+		return Lease{}, ErrNotFound
+	}
+	l.ExpiresAt = now.Add(clampTtl(ttl))
+
+	return *l, nil
+}
+
+// Release returns the proxy and applies the feedback to its score. Failures
+// in the feedback count as errors of the proxy and the client.
+func Release(id string, feedback Feedback) error {
+	mtx.Lock()
+	expire(time.Now())
+	l, ok := leases[id]
+	if ok {
+		remove(l)
+	}
+	mtx.Unlock()
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	outcomes := feedback.outcomes()
+	if len(outcomes) == 0 {
+		releasesTotal.Inc("none")
+		return nil
+	}
+
+	var failures usage.Counters
+	for _, success := range outcomes {
+		if !success {
+			failures.Errors++
+		}
+	}
+	if failures.Errors > 0 {
+		releasesTotal.Inc("failure")
+		usage.Record(usage.KIND_CLIENT, l.Client, failures)
+		usage.Record(usage.KIND_PROXY, l.Proxy.Key(), failures)
+	} else {
+		releasesTotal.Inc("success")
+	}
+
+	proxy.Modify(l.Proxy.Key(), func(p *proxy.Proxy) {
+		for _, success := range outcomes {
+			p.AdjustScore(success, proxy.FeedbackScoreWeight)
+		}
+	})
+
+	return nil
+}
+
+func (f Feedback) outcomes() []bool {
+	var result []bool
+	switch f.Outcome {
+	case "success":
+		result = append(result, true)
+	case "failure":
+		result = append(result, false)
+	}
+	for _, code := range f.StatusCodes {
+		result = append(result, !proxy.IsFailureStatus(code) && !proxy.IsBlockedStatus(code))
+	}
+	return result
+}
+
+// GetAll returns the active leases ordered by expiry.
+func GetAll() []Lease {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	expire(time.Now())
+
+	result := make([]Lease, 0, len(leases))
+	for _, l := range leases {
+		result = append(result, *l)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].ExpiresAt.Before(result[j].ExpiresAt)
+	})
+	return result
+}
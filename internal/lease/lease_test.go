@@ -0,0 +1,123 @@
+package lease
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+func loadConfig(t *testing.T, text string) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Load(path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestAcquireIsExclusive(t *testing.T) {
+	loadConfig(t, "parse_period: 1h\ncheck_period: 1h\n")
+
+	const working = 3
+	var pl []proxy.Proxy
+	for i := 0; i < working; i++ {
+		pl = append(pl, proxy.Proxy{
+			Ip:       fmt.Sprintf("10.1.0.%d", i),
+			Port:     "3128",
+			Protocol: proxy.PROTO_HTTP,
+			IsWork:   true,
+		})
+	}
+	proxy.AddList(pl)
+
+	var wg sync.WaitGroup
+	var leasedMtx sync.Mutex
+	leased := make(map[string]int)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			l, err := Acquire(proxy.Filter{}, proxy.PICK_UNIFORM, 0, "test")
+			if err != nil {
+				return
+			}
+			leasedMtx.Lock()
+			leased[l.Proxy.Key()]++
+			leasedMtx.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	if len(leased) != working {
+		t.Fatalf("%d proxies leased, want %d", len(leased), working)
+	}
+	for key, n := range leased {
+		if n != 1 {
+			t.Errorf("proxy '%s' leased %d times", key, n)
+		}
+	}
+
+	picked, _, err := proxy.PickWorkingExcept(proxy.Filter{}, proxy.PICK_UNIFORM, working, Reserved())
+	if err != nil || len(picked) != 0 {
+		t.Fatalf("picked %d leased proxies outside of leases: %v", len(picked), err)
+	}
+}
+
+func TestNegativeMaxPerProxy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	text := "parse_period: 1h\ncheck_period: 1h\nleases:\n  max_per_proxy: -1\n"
+	if err := os.WriteFile(path, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.Load(path); err == nil {
+		t.Fatal("negative max_per_proxy accepted")
+	}
+}
+
+// TestActiveGaugeIsReadOnly checks that a scrape counts only the live leases
+// and leaves the expired ones in place.
+func TestActiveGaugeIsReadOnly(t *testing.T) {
+	loadConfig(t, "parse_period: 1h\ncheck_period: 1h\nleases:\n  max_per_proxy: 100\n")
+
+	proxy.AddList([]proxy.Proxy{{Ip: "10.2.0.1", Port: "3128", Protocol: proxy.PROTO_HTTP, IsWork: true}})
+	if _, err := Acquire(proxy.Filter{}, proxy.PICK_UNIFORM, time.Millisecond, "test"); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(5 * time.Millisecond)
+
+	mtx.Lock()
+	before := len(leases)
+	live := 0
+	for _, l := range leases {
+		if time.Now().Before(l.ExpiresAt) {
+			live++
+		}
+	}
+	mtx.Unlock()
+
+	var b strings.Builder
+	if err := metrics.Write(&b); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := fmt.Sprintf("ppc_leases_active %d\n", live); !strings.Contains(b.String(), want) {
+		t.Errorf("metrics lack '%s'", strings.TrimSpace(want))
+	}
+	mtx.Lock()
+	after := len(leases)
+	mtx.Unlock()
+	if after != before {
+		t.Errorf("scrape changed the leases from %d to %d", before, after)
+	}
+}
@@ -0,0 +1,314 @@
+// Package metrics keeps counters, histograms and gauges and writes them in
+// the Prometheus text format. Metrics are registered when they are created,
+// usually in package level variables of the package they describe.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DurationBuckets are the default histogram buckets for durations in
+// seconds.
+var DurationBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+type metric interface {
+	name() string
+	write(w *bufio.Writer)
+}
+
+var (
+	registryMtx sync.Mutex
+	registry    []metric
+)
+
+func register(m metric) {
+	registryMtx.Lock()
+	defer registryMtx.Unlock()
+
+	for _, r := range registry {
+		if r.name() == m.name() {
+			panic(fmt.Sprintf("metric '%s' registered twice", m.name()))
+		}
+	}
+	registry = append(registry, m)
+	sort.Slice(registry, func(i, j int) bool {
+		return registry[i].name() < registry[j].name()
+	})
+}
+
+// Write writes all registered metrics in the Prometheus text format.
+func Write(w io.Writer) error {
+	registryMtx.Lock()
+	metrics := append([]metric(nil), registry...)
+	registryMtx.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// formatLabels renders {a="x",b="y"}, or nothing without labels. extra is
+// appended as is, it is used for the le label of histogram buckets.
+func formatLabels(names, values []string, extra string) string {
+	if len(names) == 0 && extra == "" {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(name)
+		b.WriteString(`="`)
+		b.WriteString(labelEscaper.Replace(values[i]))
+		b.WriteByte('"')
+	}
+	if extra != "" {
+		if len(names) > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(extra)
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	default:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, helpEscaper.Replace(help), name, kind)
+}
+
+// seriesKey joins label values into a map key.
+func seriesKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func checkLabels(name string, labels, values []string) {
+	if len(values) != len(labels) {
+		panic(fmt.Sprintf("metric '%s' expects %d label values, got %d", name, len(labels), len(values)))
+	}
+}
+
+// sortedKeys returns the series keys in a stable order for the output.
+func sortedKeys[T any](series map[string]T) []string {
+	keys := make([]string, 0, len(series))
+	for k := range series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type counterSeries struct {
+	values []string
+	value  float64
+}
+
+// CounterVec is a counter partitioned by labels.
+type CounterVec struct {
+	metricName string
+	help       string
+	labels     []string
+	mtx        sync.Mutex
+	series     map[string]*counterSeries
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		series:     make(map[string]*counterSeries),
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) name() string {
+	return c.metricName
+}
+
+// Add adds v, which must not be negative, to the series of the label values.
+func (c *CounterVec) Add(v float64, values ...string) {
+	checkLabels(c.metricName, c.labels, values)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	key := seriesKey(values)
+	s, ok := c.series[key]
+	if !ok {
+		s = &counterSeries{values: append([]string(nil), values...)}
+		c.series[key] = s
+	}
+	s.value += v
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	writeHeader(w, c.metricName, c.help, "counter")
+	for _, key := range sortedKeys(c.series) {
+		s := c.series[key]
+		fmt.Fprintf(w, "%s%s %s\n", c.metricName, formatLabels(c.labels, s.values, ""), formatValue(s.value))
+	}
+}
+
+type histogramSeries struct {
+	values []string
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// HistogramVec counts observations in buckets, partitioned by labels.
+type HistogramVec struct {
+	metricName string
+	help       string
+	labels     []string
+	buckets    []float64
+	mtx        sync.Mutex
+	series     map[string]*histogramSeries
+}
+
+// NewHistogramVec registers a histogram with the upper bounds of buckets,
+// the +Inf bucket is added on output.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	buckets = append([]float64(nil), buckets...)
+	sort.Float64s(buckets)
+
+	h := &HistogramVec{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		buckets:    buckets,
+		series:     make(map[string]*histogramSeries),
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) name() string {
+	return h.metricName
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	checkLabels(h.metricName, h.labels, values)
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	key := seriesKey(values)
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogramSeries{
+			values: append([]string(nil), values...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.sum += v
+	s.count++
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	writeHeader(w, h.metricName, h.help, "histogram")
+	for _, key := range sortedKeys(h.series) {
+		s := h.series[key]
+
+		// Buckets are stored per range and written cumulative.
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += s.counts[i]
+			le := fmt.Sprintf(`le="%s"`, formatValue(le))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.values, le), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.metricName, formatLabels(h.labels, s.values, `le="+Inf"`), s.count)
+
+		labels := formatLabels(h.labels, s.values, "")
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.metricName, labels, formatValue(s.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.metricName, labels, s.count)
+	}
+}
+
+// GaugeFunc is a gauge whose values are collected when the metrics are
+// written, for state that is kept elsewhere like pool sizes.
+type GaugeFunc struct {
+	metricName string
+	help       string
+	labels     []string
+	collect    func(emit func(v float64, values ...string))
+}
+
+// NewGaugeFunc registers a gauge. collect calls emit once per series.
+func NewGaugeFunc(name, help string, labels []string, collect func(emit func(v float64, values ...string))) *GaugeFunc {
+	g := &GaugeFunc{
+		metricName: name,
+		help:       help,
+		labels:     labels,
+		collect:    collect,
+	}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) name() string {
+	return g.metricName
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	series := make(map[string]*counterSeries)
+	g.collect(func(v float64, values ...string) {
+		checkLabels(g.metricName, g.labels, values)
+		key := seriesKey(values)
+		if s, ok := series[key]; ok {
+			s.value += v
+			return
+		}
+		series[key] = &counterSeries{values: append([]string(nil), values...), value: v}
+	})
+
+	writeHeader(w, g.metricName, g.help, "gauge")
+	for _, key := range sortedKeys(series) {
+		s := series[key]
+		fmt.Fprintf(w, "%s%s %s\n", g.metricName, formatLabels(g.labels, s.values, ""), formatValue(s.value))
+	}
+}
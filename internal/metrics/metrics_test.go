@@ -0,0 +1,97 @@
+package metrics
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+func output(m metric) string {
+	var b strings.Builder
+	w := bufio.NewWriter(&b)
+	m.write(w)
+	w.Flush()
+	return b.String()
+}
+
+func checkOutput(t *testing.T, m metric, want string) {
+	t.Helper()
+
+	if got := output(m); got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+}
+
+func TestHistogramBucketsAreCumulative(t *testing.T) {
+	h := NewHistogramVec("test_histogram_seconds", "Test histogram.", []float64{5, 1, 2}, "kind")
+	for _, v := range []float64{0.5, 1, 1.5, 3, 10} {
+		h.Observe(v, "a")
+	}
+	h.Observe(2, "b")
+
+	// A value on a bound counts in its bucket, le is inclusive.
+	checkOutput(t, h, `# HELP test_histogram_seconds Test histogram.
+# TYPE test_histogram_seconds histogram
+test_histogram_seconds_bucket{kind="a",le="1"} 2
+test_histogram_seconds_bucket{kind="a",le="2"} 3
+test_histogram_seconds_bucket{kind="a",le="5"} 4
+test_histogram_seconds_bucket{kind="a",le="+Inf"} 5
+test_histogram_seconds_sum{kind="a"} 16
+test_histogram_seconds_count{kind="a"} 5
+test_histogram_seconds_bucket{kind="b",le="1"} 0
+test_histogram_seconds_bucket{kind="b",le="2"} 1
+test_histogram_seconds_bucket{kind="b",le="5"} 1
+test_histogram_seconds_bucket{kind="b",le="+Inf"} 1
+test_histogram_seconds_sum{kind="b"} 2
+test_histogram_seconds_count{kind="b"} 1
+`)
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	h := NewHistogramVec("test_plain_histogram", "Plain.", []float64{0.25})
+	h.Observe(0.1)
+
+	checkOutput(t, h, `# HELP test_plain_histogram Plain.
+# TYPE test_plain_histogram histogram
+test_plain_histogram_bucket{le="0.25"} 1
+test_plain_histogram_bucket{le="+Inf"} 1
+test_plain_histogram_sum 0.1
+test_plain_histogram_count 1
+`)
+}
+
+func TestEscaping(t *testing.T) {
+	c := NewCounterVec("test_escaped_total", "Help with a \\ and a\nnew line.", "url")
+	c.Inc("http://x/\"q\"\\path\nnext")
+	c.Add(2.5, "plain")
+
+	checkOutput(t, c, `# HELP test_escaped_total Help with a \\ and a\nnew line.
+# TYPE test_escaped_total counter
+test_escaped_total{url="http://x/\"q\"\\path\nnext"} 1
+test_escaped_total{url="plain"} 2.5
+`)
+}
+
+func TestGaugeFuncSumsSeries(t *testing.T) {
+	g := NewGaugeFunc("test_pool_size", "Pool size.", []string{"country"}, func(emit func(v float64, values ...string)) {
+		emit(1, "DE")
+		emit(2, "US")
+		emit(3, "DE")
+	})
+
+	checkOutput(t, g, `# HELP test_pool_size Pool size.
+# TYPE test_pool_size gauge
+test_pool_size{country="DE"} 4
+test_pool_size{country="US"} 2
+`)
+}
+
+func TestRegisterTwicePanics(t *testing.T) {
+	NewCounterVec("test_twice_total", "Twice.")
+	defer func() {
+		if recover() == nil {
+			t.Error("second registration did not panic")
+		}
+	}()
+	NewCounterVec("test_twice_total", "Twice.")
+}
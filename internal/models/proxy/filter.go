@@ -0,0 +1,509 @@
+package proxy
+
+import (
+	"container/heap"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter selects, orders and pages proxies. It is parsed from the query
+// string of the API requests and of the configured exports, so both accept
+// the same parameters.
+type Filter struct {
+	Protocols     []string
+	Countries     []string
+	Anonymity     []string
+	Capabilities  []string
+	Tags          []string
+	Source        string
+	Domain        string
+	MaxLatency    time.Duration
+	MinScore      float64
+	MinThroughput float64
+	CheckedWithin time.Duration
+	DedupeExitIp  bool
+	Sort          string
+	Limit         int
+	after         *cursor
+}
+
+// Page is a part of the selected proxies. Total is the number of proxies
+// matching the filter, NextCursor is empty on the last page.
+type Page struct {
+	Proxies    []Proxy
+	Total      int
+	NextCursor string
+}
+
+// sortOrder is the natural order of a sort key, a "-" prefix in the sort
+// parameter reverses it. value and setValue move the sort value of a proxy
+// in and out of a cursor.
+type sortOrder struct {
+	less     func(a, b *Proxy) bool
+	value    func(p *Proxy) string
+	setValue func(p *Proxy, v string) error
+}
+
+var sortOrders = map[string]sortOrder{
+	"throughput": {
+		less:  func(a, b *Proxy) bool { return a.Throughput > b.Throughput },
+		value: func(p *Proxy) string { return strconv.FormatFloat(p.Throughput, 'g', -1, 64) },
+		setValue: func(p *Proxy, v string) (err error) {
+			p.Throughput, err = strconv.ParseFloat(v, 64)
+			return err
+		},
+	},
+	"score": {
+		less:  func(a, b *Proxy) bool { return a.Score > b.Score },
+		value: func(p *Proxy) string { return strconv.FormatFloat(p.Score, 'g', -1, 64) },
+		setValue: func(p *Proxy, v string) (err error) {
+			p.Score, err = strconv.ParseFloat(v, 64)
+			return err
+		},
+	},
+	"latency": {
+		less:  func(a, b *Proxy) bool { return a.PingTime < b.PingTime },
+		value: func(p *Proxy) string { return strconv.FormatInt(int64(p.PingTime), 10) },
+		setValue: func(p *Proxy, v string) error {
+			ns, err := strconv.ParseInt(v, 10, 64)
+			p.PingTime = time.Duration(ns)
+			return err
+		},
+	},
+	"last_checked": {
+		less:  func(a, b *Proxy) bool { return a.LastCheckedTime.After(b.LastCheckedTime) },
+		value: func(p *Proxy) string { return p.LastCheckedTime.Format(time.RFC3339Nano) },
+		setValue: func(p *Proxy, v string) (err error) {
+			p.LastCheckedTime, err = time.Parse(time.RFC3339Nano, v)
+			return err
+		},
+	},
+}
+
+// SplitList collects a parameter given either repeatedly or as a comma
+// separated list.
+func SplitList(values []string) []string {
+	var result []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
+
+func ParseFilter(values url.Values) (Filter, error) {
+	f := Filter{
+		Protocols:    SplitList(values["protocol"]),
+		Countries:    SplitList(values["country"]),
+		Anonymity:    SplitList(values["anonymity"]),
+		Capabilities: SplitList(values["capability"]),
+		Tags:         SplitList(values["tag"]),
+		Source:       values.Get("source"),
+		Domain:       values.Get("domain"),
+		DedupeExitIp: values.Get("dedupe") == "exit_ip",
+		Sort:         values.Get("sort"),
+	}
+
+	for i, c := range f.Countries {
+		f.Countries[i] = strings.ToUpper(c)
+	}
+
+	var err error
+
+	if f.MinThroughput, err = parseFloatParam(values, "min_throughput"); err != nil {
+		return f, err
+	}
+	if f.MinScore, err = parseFloatParam(values, "min_score"); err != nil {
+		return f, err
+	}
+	if f.MaxLatency, err = parseDurationParam(values, "max_latency"); err != nil {
+		return f, err
+	}
+	if f.CheckedWithin, err = parseDurationParam(values, "checked_within"); err != nil {
+		return f, err
+	}
+
+	if _, ok := sortOrders[strings.TrimPrefix(f.Sort, "-")]; f.Sort != "" && !ok {
+		return f, fmt.Errorf("Invalid sort '%s'", f.Sort)
+	}
+
+	if v := values.Get("limit"); v != "" {
+		f.Limit, err = strconv.Atoi(v)
+		if err != nil || f.Limit < 0 {
+			return f, fmt.Errorf("Invalid limit '%s'", v)
+		}
+	}
+
+	if v := values.Get("cursor"); v != "" {
+		f.after, err = decodeCursor(v, f.Sort)
+		if err != nil {
+			return f, fmt.Errorf("Invalid cursor '%s'", v)
+		}
+	}
+
+	return f, nil
+}
+
+func parseFloatParam(values url.Values, name string) (float64, error) {
+	v := values.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	result, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s '%s'", name, v)
+	}
+	return result, nil
+}
+
+// parseDurationParam accepts a Go duration ("1h30m") or a plain number of
+// milliseconds.
+func parseDurationParam(values url.Values, name string) (time.Duration, error) {
+	v := values.Get(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	if ms, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	result, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid %s '%s'", name, v)
+	}
+	return result, nil
+}
+
+// cursor is the position after the last proxy of a page: the sort it was
+// made for, the sort value and the key of that proxy. The next page starts
+// with the first proxy ordered after it, so proxies added or removed in
+// between don't shift the pages.
+type cursor struct {
+	Sort  string `json:"s,omitempty"`
+	Value string `json:"v,omitempty"`
+	Key   string `json:"k"`
+
+	probe *Proxy
+}
+
+func encodeCursor(sort string, p *Proxy) string {
+	c := cursor{Sort: sort, Key: p.Key()}
+	if order, ok := sortOrders[strings.TrimPrefix(sort, "-")]; ok {
+		c.Value = order.value(p)
+	}
+
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeCursor refuses a cursor made for another sort, its position means
+// nothing in a different order.
+func decodeCursor(s string, sort string) (*cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+
+	var c cursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	if c.Sort != sort || c.Key == "" {
+		return nil, fmt.Errorf("Cursor of another sort")
+	}
+
+	c.probe = &Proxy{}
+	if order, ok := sortOrders[strings.TrimPrefix(sort, "-")]; ok {
+		if err := order.setValue(c.probe, c.Value); err != nil {
+			return nil, err
+		}
+	}
+	return &c, nil
+}
+
+// Matches reports whether the proxy passes the filter. Dedupe, sorting and
+// paging don't apply to a single proxy.
+func (f *Filter) Matches(p *Proxy) bool {
+	return f.match(p, time.Now())
+}
+
+func (f *Filter) match(p *Proxy, now time.Time) bool {
+	if len(f.Protocols) > 0 && !contains(f.Protocols, p.Protocol) {
+		return false
+	}
+	if len(f.Countries) > 0 && !contains(f.Countries, p.Country) {
+		return false
+	}
+	if len(f.Anonymity) > 0 && !contains(f.Anonymity, p.Anonymity) {
+		return false
+	}
+	for _, c := range f.Capabilities {
+		if !p.HasCapability(c) {
+			return false
+		}
+	}
+	for _, t := range f.Tags {
+		if !p.HasTag(t) {
+			return false
+		}
+	}
+	if f.Source != "" && p.Source != f.Source {
+		return false
+	}
+	if f.MaxLatency > 0 && (p.PingTime == 0 || p.PingTime > f.MaxLatency) {
+		return false
+	}
+	if p.Score < f.MinScore || p.Throughput < f.MinThroughput {
+		return false
+	}
+	if f.CheckedWithin > 0 && now.Sub(p.LastCheckedTime) > f.CheckedWithin {
+		return false
+	}
+	if f.Domain != "" && p.IsBannedFor(f.Domain, now) {
+		return false
+	}
+	return true
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// candidates returns the smallest index bucket that may hold all matching
+// proxies, so narrow queries don't scan the whole list.
+func (f *Filter) candidates(workingOnly bool) map[string]*entry {
+	bucket := proxies.byKey
+	if workingOnly {
+		bucket = proxies.working
+	}
+	if len(f.Protocols) == 1 && len(proxies.byProtocol[f.Protocols[0]]) < len(bucket) {
+		bucket = proxies.byProtocol[f.Protocols[0]]
+	}
+	if len(f.Countries) == 1 && len(proxies.byCountry[f.Countries[0]]) < len(bucket) {
+		bucket = proxies.byCountry[f.Countries[0]]
+	}
+	return bucket
+}
+
+// matching returns the stored proxies matching the filter in no particular
+// order. With dedupe the proxy with the highest score is kept for every exit
+// IP. It must be called under mtx.
+func (f *Filter) matching(workingOnly bool) []*Proxy {
+	now := time.Now()
+	var matched []*Proxy
+	exitIps := make(map[string]int)
+
+	for _, e := range f.candidates(workingOnly) {
+		p := e.proxy
+		if workingOnly && (!p.IsWork || p.IsTampered) {
+			continue
+		}
+		if !f.match(p, now) {
+			continue
+		}
+		// Proxies that were never checked have no exit IP and are kept.
+		if f.DedupeExitIp && p.ExitIp != "" {
+			if i, ok := exitIps[p.ExitIp]; ok {
+				if kept := matched[i]; p.Score > kept.Score || (p.Score == kept.Score && p.Key() < kept.Key()) {
+					matched[i] = p
+				}
+				continue
+			}
+			exitIps[p.ExitIp] = len(matched)
+		}
+		matched = append(matched, p)
+	}
+
+	return matched
+}
+
+// before reports whether a is ordered before b: by the sort key of the
+// filter and then by key, so the order is stable between requests.
+func (f *Filter) before(a *Proxy, aKey string, b *Proxy, bKey string) bool {
+	if order, ok := sortOrders[strings.TrimPrefix(f.Sort, "-")]; ok {
+		if strings.HasPrefix(f.Sort, "-") {
+			a, b = b, a
+			aKey, bKey = bKey, aKey
+		}
+		if order.less(a, b) {
+			return true
+		}
+		if order.less(b, a) {
+			return false
+		}
+		if strings.HasPrefix(f.Sort, "-") {
+			aKey, bKey = bKey, aKey
+		}
+	}
+	return aKey < bKey
+}
+
+type keyed struct {
+	p   *Proxy
+	key string
+}
+
+// topHeap holds the first n proxies seen so far with the last of them on
+// top, so a page costs O(m log n) instead of sorting all m matches.
+type topHeap struct {
+	f     *Filter
+	items []keyed
+}
+
+func (h *topHeap) Len() int { return len(h.items) }
+func (h *topHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	return h.f.before(b.p, b.key, a.p, a.key)
+}
+func (h *topHeap) Swap(i, j int) { h.items[i], h.items[j] = h.items[j], h.items[i] }
+func (h *topHeap) Push(x any)    { h.items = append(h.items, x.(keyed)) }
+func (h *topHeap) Pop() any {
+	last := h.items[len(h.items)-1]
+	h.items = h.items[:len(h.items)-1]
+	return last
+}
+
+// ordered returns the proxies following the cursor of the filter in order,
+// at most n of them when n > 0.
+func (f *Filter) ordered(pl []*Proxy, n int) []*Proxy {
+	h := &topHeap{f: f}
+	for _, p := range pl {
+		item := keyed{p, p.Key()}
+		if f.after != nil && !f.before(f.after.probe, f.after.Key, item.p, item.key) {
+			continue
+		}
+		if n <= 0 || h.Len() < n {
+			heap.Push(h, item)
+			continue
+		}
+		if top := h.items[0]; f.before(item.p, item.key, top.p, top.key) {
+			h.items[0] = item
+			heap.Fix(h, 0)
+		}
+	}
+
+	items := h.items
+	sort.Slice(items, func(i, j int) bool {
+		return f.before(items[i].p, items[i].key, items[j].p, items[j].key)
+	})
+
+	result := make([]*Proxy, len(items))
+	for i := range items {
+		result[i] = items[i].p
+	}
+	return result
+}
+
+func (f *Filter) selectProxies(workingOnly bool) Page {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	matched := f.matching(workingOnly)
+	page := Page{Total: len(matched)}
+
+	// Only sorting and paging need an order, full unsorted lists are
+	// returned as they come.
+	if f.Sort == "" && f.Limit == 0 && f.after == nil {
+		page.Proxies = clones(matched)
+		return page
+	}
+
+	// One proxy more than the page tells whether there is a next page.
+	n := 0
+	if f.Limit > 0 {
+		n = f.Limit + 1
+	}
+	ordered := f.ordered(matched, n)
+	if f.Limit > 0 && len(ordered) > f.Limit {
+		ordered = ordered[:f.Limit]
+		page.NextCursor = encodeCursor(f.Sort, ordered[len(ordered)-1])
+	}
+	page.Proxies = clones(ordered)
+
+	return page
+}
+
+// SelectWorking returns the page of working proxies matching the filter.
+func SelectWorking(f Filter) Page {
+	return f.selectProxies(true)
+}
+
+// SelectAll returns the page of all proxies matching the filter.
+func SelectAll(f Filter) Page {
+	return f.selectProxies(false)
+}
+
+// bucketExact reports whether the bucket of candidates holds exactly the
+// matching proxies, so they can be counted from its size. The protocol and
+// country buckets include proxies that don't work.
+func (f *Filter) bucketExact(workingOnly bool) bool {
+	if len(f.Anonymity) > 0 || len(f.Capabilities) > 0 || len(f.Tags) > 0 ||
+		f.Source != "" || f.Domain != "" || f.MaxLatency > 0 || f.MinScore > 0 ||
+		f.MinThroughput > 0 || f.CheckedWithin > 0 || f.DedupeExitIp {
+		return false
+	}
+	narrowed := len(f.Protocols) + len(f.Countries)
+	return narrowed == 0 || (!workingOnly && narrowed == 1)
+}
+
+// count returns the number of proxies matching the filter without collecting
+// them. It must be called under mtx.
+func (f *Filter) count(workingOnly bool) int {
+	bucket := f.candidates(workingOnly)
+	if f.bucketExact(workingOnly) {
+		return len(bucket)
+	}
+
+	now := time.Now()
+	n := 0
+	exitIps := make(map[string]struct{})
+	for _, e := range bucket {
+		p := e.proxy
+		if workingOnly && (!p.IsWork || p.IsTampered) {
+			continue
+		}
+		if !f.match(p, now) {
+			continue
+		}
+		if f.DedupeExitIp && p.ExitIp != "" {
+			if _, ok := exitIps[p.ExitIp]; ok {
+				continue
+			}
+			exitIps[p.ExitIp] = struct{}{}
+		}
+		n++
+	}
+	return n
+}
+
+// CountWorking returns the number of working proxies matching the filter.
+func CountWorking(f Filter) int {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return f.count(true)
+}
+
+// CountAll returns the number of proxies matching the filter.
+func CountAll(f Filter) int {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return f.count(false)
+}
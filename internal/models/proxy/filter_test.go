@@ -0,0 +1,165 @@
+package proxy
+
+import (
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func pageTestProxy(i int) Proxy {
+	p := testProxy(i)
+	p.IsWork = true
+	p.Score = float64(i % 7)
+	p.Throughput = float64(i%5) / 3
+	p.PingTime = time.Duration(i%11) * time.Millisecond
+	p.LastCheckedTime = time.Unix(1700000000, int64(i%13))
+	return p
+}
+
+// allPages follows the cursors from the first page to the last.
+func allPages(t *testing.T, sort string, limit int, between func(page int)) []string {
+	t.Helper()
+
+	var keys []string
+	values := url.Values{"sort": {sort}, "limit": {strconv.Itoa(limit)}}
+	for page := 0; ; page++ {
+		f, err := ParseFilter(values)
+		if err != nil {
+			t.Fatalf("page %d: %v", page, err)
+		}
+		p := SelectWorking(f)
+		if len(p.Proxies) > limit {
+			t.Fatalf("page %d has %d proxies", page, len(p.Proxies))
+		}
+		for _, proxy := range p.Proxies {
+			keys = append(keys, proxy.Key())
+		}
+		if p.NextCursor == "" {
+			return keys
+		}
+		if between != nil {
+			between(page)
+		}
+		values.Set("cursor", p.NextCursor)
+	}
+}
+
+func TestSelectPages(t *testing.T) {
+	var pl []Proxy
+	for i := 0; i < 100; i++ {
+		pl = append(pl, pageTestProxy(i))
+	}
+	resetProxies(pl)
+
+	for _, sort := range []string{"", "score", "-score", "throughput", "latency", "-latency", "last_checked", "-last_checked"} {
+		t.Run("sort="+sort, func(t *testing.T) {
+			full := SelectWorking(Filter{Sort: sort, Limit: 1000})
+			if full.NextCursor != "" || full.Total != len(pl) {
+				t.Fatalf("full page: total %d, cursor '%s'", full.Total, full.NextCursor)
+			}
+
+			keys := allPages(t, sort, 7, nil)
+			if len(keys) != len(full.Proxies) {
+				t.Fatalf("pages hold %d proxies, want %d", len(keys), len(full.Proxies))
+			}
+			for i, key := range keys {
+				if key != full.Proxies[i].Key() {
+					t.Fatalf("proxy %d is '%s', want '%s'", i, key, full.Proxies[i].Key())
+				}
+			}
+		})
+	}
+}
+
+// TestCursorSurvivesChanges removes proxies already paged through and adds
+// ones ordered before the cursor between pages. The remaining proxies must
+// come exactly once.
+func TestCursorSurvivesChanges(t *testing.T) {
+	var pl []Proxy
+	for i := 0; i < 100; i++ {
+		pl = append(pl, pageTestProxy(i))
+	}
+	resetProxies(pl)
+
+	want := SelectWorking(Filter{Sort: "score", Limit: 1000})
+
+	seen := make(map[string]int)
+	next := 100
+	keys := allPages(t, "score", 7, func(page int) {
+		Delete(want.Proxies[page])
+		p := pageTestProxy(next)
+		p.Score = 100
+		Add(p)
+		next++
+	})
+	for _, key := range keys {
+		seen[key]++
+	}
+
+	for _, p := range want.Proxies {
+		if seen[p.Key()] != 1 {
+			t.Errorf("proxy '%s' seen %d times", p.Key(), seen[p.Key()])
+		}
+	}
+	for i := 100; i < next; i++ {
+		if seen[testKey(i)] != 0 {
+			t.Errorf("proxy '%s' added before the cursor was returned", testKey(i))
+		}
+	}
+}
+
+func TestCursorOfAnotherSort(t *testing.T) {
+	resetProxies([]Proxy{pageTestProxy(1), pageTestProxy(2)})
+
+	f, err := ParseFilter(url.Values{"sort": {"score"}, "limit": {"1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	page := SelectWorking(f)
+	if page.NextCursor == "" {
+		t.Fatal("no next cursor")
+	}
+
+	_, err = ParseFilter(url.Values{"sort": {"latency"}, "limit": {"1"}, "cursor": {page.NextCursor}})
+	if err == nil {
+		t.Fatal("cursor of sort=score accepted for sort=latency")
+	}
+}
+
+// TestCountMatchesSelect compares the counts, partly taken from the bucket
+// sizes, with the number of selected proxies.
+func TestCountMatchesSelect(t *testing.T) {
+	var pl []Proxy
+	for i := 0; i < 200; i++ {
+		p := benchProxy(i)
+		if i%3 == 0 {
+			p.Protocol = PROTO_SOCKS5
+		}
+		if i%4 == 0 {
+			p.ExitIp = "192.0.2." + strconv.Itoa(i%5)
+		}
+		p.IsTampered = i%20 == 0
+		pl = append(pl, p)
+	}
+	resetProxies(pl)
+
+	filters := []Filter{
+		{},
+		{Protocols: []string{PROTO_SOCKS5}},
+		{Countries: []string{"DE"}},
+		{Protocols: []string{PROTO_SOCKS5}, Countries: []string{"DE"}},
+		{Protocols: []string{PROTO_HTTP, PROTO_SOCKS5}},
+		{MinScore: 50},
+		{DedupeExitIp: true},
+		{Countries: []string{"XX"}},
+	}
+	for _, f := range filters {
+		if got, want := CountWorking(f), SelectWorking(f).Total; got != want {
+			t.Errorf("%+v: %d working, want %d", f, got, want)
+		}
+		if got, want := CountAll(f), SelectAll(f).Total; got != want {
+			t.Errorf("%+v: %d in all, want %d", f, got, want)
+		}
+	}
+}
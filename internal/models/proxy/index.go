@@ -0,0 +1,226 @@
+package proxy
+
+import (
+	"container/heap"
+	"time"
+)
+
+type entry struct {
+	proxy *Proxy
+
+	// Values the secondary indexes were built from, used to move the entry
+	// between index buckets when the proxy changes.
+	working bool
+	country string
+	dueAt   time.Time
+	queued  bool
+}
+
+type dueItem struct {
+	key   string
+	dueAt time.Time
+}
+
+// dueQueue is a min-heap of proxies ordered by the time of their next check.
+// Entries are not removed on update, stale ones are skipped on pop.
+type dueQueue []dueItem
+
+func (q dueQueue) Len() int           { return len(q) }
+func (q dueQueue) Less(i, j int) bool { return q[i].dueAt.Before(q[j].dueAt) }
+func (q dueQueue) Swap(i, j int)      { q[i], q[j] = q[j], q[i] }
+func (q *dueQueue) Push(x any)        { *q = append(*q, x.(dueItem)) }
+func (q *dueQueue) Pop() any {
+	old := *q
+	item := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return item
+}
+
+// index holds proxies by (protocol, ip, port) with secondary indexes for the
+// working set, country, protocol and the next check time.
+type index struct {
+	byKey      map[string]*entry
+	working    map[string]*entry
+	byCountry  map[string]map[string]*entry
+	byProtocol map[string]map[string]*entry
+	due        dueQueue
+
+	// watched is set once the list is loaded, the initial inserts are not
+	// reported as changes.
+	watched bool
+}
+
+func newIndex() *index {
+	return &index{
+		byKey:      make(map[string]*entry),
+		working:    make(map[string]*entry),
+		byCountry:  make(map[string]map[string]*entry),
+		byProtocol: make(map[string]map[string]*entry),
+	}
+}
+
+func (ix *index) len() int {
+	return len(ix.byKey)
+}
+
+func (ix *index) get(key string) *Proxy {
+	if e, ok := ix.byKey[key]; ok {
+		return e.proxy
+	}
+	return nil
+}
+
+func (ix *index) insert(p *Proxy) bool {
+	key := p.Key()
+	if _, ok := ix.byKey[key]; ok {
+		return false
+	}
+
+	e := &entry{proxy: p}
+	ix.byKey[key] = e
+	addToBucket(ix.byProtocol, p.Protocol, key, e)
+	ix.reindex(e)
+
+	return true
+}
+
+func (ix *index) remove(key string) *Proxy {
+	e, ok := ix.byKey[key]
+	if !ok {
+		return nil
+	}
+
+	delete(ix.byKey, key)
+	delete(ix.working, key)
+	removeFromBucket(ix.byCountry, e.country, key)
+	removeFromBucket(ix.byProtocol, e.proxy.Protocol, key)
+
+	return e.proxy
+}
+
+// reindex moves the entry to the right buckets after its proxy changed.
+func (ix *index) reindex(e *entry) {
+	key := e.proxy.Key()
+
+	working := e.proxy.IsWork && !e.proxy.IsTampered
+	if working != e.working {
+		if working {
+			ix.working[key] = e
+		} else {
+			delete(ix.working, key)
+		}
+		e.working = working
+		if ix.watched {
+			if working {
+				notify(CHANGE_WORKING, e.proxy)
+			} else {
+				notify(CHANGE_DIED, e.proxy)
+			}
+		}
+	}
+
+	if e.proxy.Country != e.country {
+		removeFromBucket(ix.byCountry, e.country, key)
+		e.country = e.proxy.Country
+	}
+	if e.country != "" {
+		addToBucket(ix.byCountry, e.country, key, e)
+	}
+
+	if e.proxy.FailsCount >= MaxFailsCount {
+		e.queued = false
+		return
+	}
+
+	dueAt := e.proxy.LastCheckedTime.Add(checkPeriodDuration)
+	if e.proxy.LastCheckedTime.IsZero() {
+		dueAt = time.Time{}
+	}
+	if !e.queued || !dueAt.Equal(e.dueAt) {
+		e.dueAt = dueAt
+		e.queued = true
+		heap.Push(&ix.due, dueItem{key: key, dueAt: dueAt})
+	}
+}
+
+func (ix *index) reindexKey(key string) {
+	if e, ok := ix.byKey[key]; ok {
+		ix.reindex(e)
+	}
+}
+
+// popDue returns the proxy with the earliest next check time if it is due.
+func (ix *index) popDue(now time.Time) *Proxy {
+	for ix.due.Len() > 0 {
+		top := ix.due[0]
+		e, ok := ix.byKey[top.key]
+		if !ok || !e.queued || !e.dueAt.Equal(top.dueAt) {
+			heap.Pop(&ix.due)
+			continue
+		}
+		if top.dueAt.After(now) {
+			return nil
+		}
+		heap.Pop(&ix.due)
+		e.queued = false
+		return e.proxy
+	}
+
+	return nil
+}
+
+// rebuildDue drops stale heap items, it is needed after the check period
+// changes since all due times move.
+func (ix *index) rebuildDue() {
+	ix.due = ix.due[:0]
+	for _, e := range ix.byKey {
+		e.queued = false
+		ix.reindex(e)
+	}
+}
+
+// The buckets are unordered, callers that need an order sort the result.
+
+func (ix *index) all() []*Proxy {
+	return bucketProxies(ix.byKey)
+}
+
+func (ix *index) workingProxies() []*Proxy {
+	return bucketProxies(ix.working)
+}
+
+func (ix *index) countryProxies(country string) []*Proxy {
+	return bucketProxies(ix.byCountry[country])
+}
+
+func (ix *index) protocolProxies(protocol string) []*Proxy {
+	return bucketProxies(ix.byProtocol[protocol])
+}
+
+func bucketProxies(bucket map[string]*entry) []*Proxy {
+	result := make([]*Proxy, 0, len(bucket))
+	for _, e := range bucket {
+		result = append(result, e.proxy)
+	}
+	return result
+}
+
+func addToBucket(buckets map[string]map[string]*entry, name, key string, e *entry) {
+	bucket, ok := buckets[name]
+	if !ok {
+		bucket = make(map[string]*entry)
+		buckets[name] = bucket
+	}
+	bucket[key] = e
+}
+
+func removeFromBucket(buckets map[string]map[string]*entry, name, key string) {
+	bucket, ok := buckets[name]
+	if !ok {
+		return
+	}
+	delete(bucket, key)
+	if len(bucket) == 0 {
+		delete(buckets, name)
+	}
+}
@@ -0,0 +1,103 @@
+package proxy
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+const benchSize = 1_000_000
+
+var (
+	benchOnce      sync.Once
+	benchCountries = []string{"US", "DE", "FR", "NL", "RU", "BR", "IN", "JP"}
+)
+
+func benchProxy(i int) Proxy {
+	return Proxy{
+		Ip:       fmt.Sprintf("%d.%d.%d.%d", 10+i>>24, i>>16&0xff, i>>8&0xff, i&0xff),
+		Port:     "8080",
+		Protocol: PROTO_HTTP,
+		Country:  benchCountries[i%len(benchCountries)],
+		IsWork:   i%10 == 0,
+		Score:    float64(i % 100),
+	}
+}
+
+// resetProxies replaces the list with the given proxies.
+func resetProxies(pl []Proxy) {
+	mtx.Lock()
+	proxies = newIndex()
+	dirty = make(map[string]struct{})
+	deleted = make(map[string]Proxy)
+	mtx.Unlock()
+
+	AddList(pl)
+}
+
+// fillBench loads benchSize proxies once for all benchmarks, every tenth of
+// them working.
+func fillBench(b *testing.B) {
+	benchOnce.Do(func() {
+		pl := make([]Proxy, benchSize)
+		for i := range pl {
+			pl[i] = benchProxy(i)
+		}
+		resetProxies(pl)
+	})
+	b.ResetTimer()
+}
+
+func BenchmarkAdd(b *testing.B) {
+	fillBench(b)
+
+	for i := 0; i < b.N; i++ {
+		Add(benchProxy(benchSize + i))
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	fillBench(b)
+
+	keys := make([]string, 1024)
+	for i := range keys {
+		p := benchProxy(i * (benchSize / len(keys)))
+		keys[i] = p.Key()
+	}
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, ok := Get(keys[i%len(keys)]); !ok {
+			b.Fatal("proxy not found")
+		}
+	}
+}
+
+func BenchmarkQuery(b *testing.B) {
+	fillBench(b)
+
+	queries := []struct {
+		name   string
+		filter Filter
+	}{
+		{"working_page", Filter{Limit: 10}},
+		{"working_country_page", Filter{Countries: []string{"DE"}, Limit: 10}},
+		{"working_sorted_page", Filter{Sort: "score", Limit: 10}},
+		{"working_min_score", Filter{MinScore: 95}},
+	}
+	for _, q := range queries {
+		b.Run(q.name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				SelectWorking(q.filter)
+			}
+		})
+	}
+
+	b.Run("pick", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, _, err := PickWorking(Filter{}, PICK_UNIFORM, 1); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
+)
+
+// status returns the state of the proxy for the pool size metric.
+func (p *Proxy) status() string {
+	switch {
+	case p.FailsCount >= MaxFailsCount:
+		return "blocked"
+	case p.IsTampered:
+		return "tampered"
+	case p.IsWork:
+		return "working"
+	case p.LastCheckedTime.IsZero():
+		return "unchecked"
+	default:
+		return "failing"
+	}
+}
+
+func init() {
+	metrics.NewGaugeFunc("ppc_proxies", "Proxies in the list by protocol, country and status.",
+		[]string{"protocol", "country", "status"},
+		func(emit func(v float64, values ...string)) {
+			mtx.RLock()
+			defer mtx.RUnlock()
+
+			for _, e := range proxies.byKey {
+				emit(1, e.proxy.Protocol, e.proxy.Country, e.proxy.status())
+			}
+		})
+
+	metrics.NewGaugeFunc("ppc_check_queue", "Proxies waiting for a check, due now or later.",
+		[]string{"state"},
+		func(emit func(v float64, values ...string)) {
+			mtx.RLock()
+			defer mtx.RUnlock()
+
+			now := time.Now()
+			due, scheduled := 0, 0
+			for _, e := range proxies.byKey {
+				switch {
+				case !e.queued:
+				case e.dueAt.After(now):
+					scheduled++
+				default:
+					due++
+				}
+			}
+			emit(float64(due), "due")
+			emit(float64(scheduled), "scheduled")
+		})
+}
@@ -0,0 +1,171 @@
+package proxy
+
+import (
+	"container/heap"
+	"fmt"
+	"math/rand/v2"
+	"sort"
+	"time"
+)
+
+const (
+	PICK_UNIFORM  = "uniform"
+	PICK_WEIGHTED = "weighted"
+	PICK_LRU      = "lru"
+
+	// minPickWeight keeps proxies with a zero score selectable in the
+	// weighted mode.
+	minPickWeight = 1.0
+)
+
+func IsValidPickMode(mode string) bool {
+	switch mode {
+	case PICK_UNIFORM, PICK_WEIGHTED, PICK_LRU:
+		return true
+	}
+	return false
+}
+
+// PickWorking returns up to count distinct working proxies matching the
+// filter, chosen by mode, and the number of proxies they were chosen from.
+// The picked proxies are marked as handed out now for the lru mode. Picks
+// run under the read lock, so two concurrent lru picks may return the same
+// proxy.
+func PickWorking(f Filter, mode string, count int) ([]Proxy, int, error) {
+	return PickWorkingExcept(f, mode, count, nil)
+}
+
+// PickWorkingExcept is PickWorking that leaves out the proxies for whose key
+// skip returns true.
+func PickWorkingExcept(f Filter, mode string, count int, skip func(key string) bool) ([]Proxy, int, error) {
+	if !IsValidPickMode(mode) {
+		return nil, 0, fmt.Errorf("Invalid mode '%s'", mode)
+	}
+
+	mtx.RLock()
+	matched := f.matching(true)
+	if skip != nil {
+		var kept []*Proxy
+		for _, p := range matched {
+			if !skip(p.Key()) {
+				kept = append(kept, p)
+			}
+		}
+		matched = kept
+	}
+	total := len(matched)
+	count = min(count, total)
+
+	var picked []*Proxy
+	switch mode {
+	case PICK_UNIFORM:
+		picked = pickUniform(matched, count)
+	case PICK_WEIGHTED:
+		picked = pickWeighted(matched, count)
+	case PICK_LRU:
+		picked = pickLeastRecent(matched, count)
+	}
+	result := clones(picked)
+	mtx.RUnlock()
+
+	markHandedOut(result, time.Now())
+
+	return result, total, nil
+}
+
+// markHandedOut sets the hand out time of the stored proxies. It takes the
+// write lock only for the picked proxies, the hand out time is not indexed.
+func markHandedOut(pl []Proxy, now time.Time) {
+	if len(pl) == 0 {
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	for i := range pl {
+		pl[i].LastHandedOut = now
+		if e, ok := proxies.byKey[pl[i].Key()]; ok {
+			e.proxy.LastHandedOut = now
+		}
+	}
+}
+
+// pickUniform runs the first count steps of a Fisher-Yates shuffle.
+func pickUniform(pl []*Proxy, count int) []*Proxy {
+	for i := 0; i < count; i++ {
+		j := i + rand.IntN(len(pl)-i)
+		pl[i], pl[j] = pl[j], pl[i]
+	}
+	return pl[:count]
+}
+
+// pickWeighted draws proxies with a probability proportional to their score,
+// without replacement.
+func pickWeighted(pl []*Proxy, count int) []*Proxy {
+	weights := make([]float64, len(pl))
+	var total float64
+	for i, p := range pl {
+		weights[i] = max(p.Score, minPickWeight)
+		total += weights[i]
+	}
+
+	var result []*Proxy
+	for len(result) < count {
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(pl)-1; i++ {
+			if r < weights[i] {
+				break
+			}
+			r -= weights[i]
+		}
+
+		result = append(result, pl[i])
+		total -= weights[i]
+		last := len(pl) - 1
+		pl[i], pl[last] = pl[last], pl[i]
+		weights[i], weights[last] = weights[last], weights[i]
+		pl, weights = pl[:last], weights[:last]
+	}
+	return result
+}
+
+// handedOutHeap keeps the proxy handed out most recently on top.
+type handedOutHeap []*Proxy
+
+func (h handedOutHeap) Len() int           { return len(h) }
+func (h handedOutHeap) Less(i, j int) bool { return h[i].LastHandedOut.After(h[j].LastHandedOut) }
+func (h handedOutHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *handedOutHeap) Push(x any)        { *h = append(*h, x.(*Proxy)) }
+func (h *handedOutHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// pickLeastRecent returns the proxies handed out longest ago, the ones never
+// handed out first. Only count proxies are kept ordered, not all of them.
+func pickLeastRecent(pl []*Proxy, count int) []*Proxy {
+	if count == 0 {
+		return nil
+	}
+
+	h := make(handedOutHeap, 0, count)
+	for _, p := range pl {
+		if len(h) < count {
+			heap.Push(&h, p)
+			continue
+		}
+		if p.LastHandedOut.Before(h[0].LastHandedOut) {
+			h[0] = p
+			heap.Fix(&h, 0)
+		}
+	}
+
+	sort.Slice(h, func(i, j int) bool {
+		return h[i].LastHandedOut.Before(h[j].LastHandedOut)
+	})
+	return h
+}
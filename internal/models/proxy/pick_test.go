@@ -0,0 +1,28 @@
+package proxy
+
+import "testing"
+
+func TestPickLeastRecentRotates(t *testing.T) {
+	var pl []Proxy
+	for i := 0; i < 5; i++ {
+		pl = append(pl, pageTestProxy(i))
+	}
+	resetProxies(pl)
+
+	seen := make(map[string]bool)
+	for i := 0; i < len(pl); i++ {
+		picked, total, err := PickWorking(Filter{}, PICK_LRU, 1)
+		if err != nil || total != len(pl) || len(picked) != 1 {
+			t.Fatalf("pick %d: %v, total %d, picked %d", i, err, total, len(picked))
+		}
+		if seen[picked[0].Key()] {
+			t.Fatalf("pick %d returned '%s' again", i, picked[0].Key())
+		}
+		seen[picked[0].Key()] = true
+
+		stored, _ := Get(picked[0].Key())
+		if stored.LastHandedOut.IsZero() {
+			t.Fatalf("hand out time of '%s' not stored", picked[0].Key())
+		}
+	}
+}
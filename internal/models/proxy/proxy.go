@@ -2,145 +2,645 @@ package proxy
 
 import (
 	"fmt"
-	"os"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/hightemp/proxy_parser_checker/internal/fileutil"
 	"github.com/hightemp/proxy_parser_checker/internal/logger"
 	"gopkg.in/yaml.v3"
 )
 
 const (
-	PROTO_HTTP  = "http"
-	PROTO_HTTPS = "https"
+	PROTO_HTTP   = "http"
+	PROTO_HTTPS  = "https"
+	PROTO_SOCKS5 = "socks5"
 
 	MaxFailsCount = 3
+
+	CAP_HTTP_FORWARD = "http_forward"
+	CAP_CONNECT_443  = "connect_443"
+	CAP_CONNECT_ANY  = "connect_any"
+
+	TAG_ROTATING = "rotating"
+
+	// CheckScoreWeight is the weight of a single check outcome in the score.
+	CheckScoreWeight = 0.2
+	// ReportScoreWeight is the weight of a client report in the score.
+	ReportScoreWeight = 0.2
+	// FeedbackScoreWeight is the weight of an outcome reported when a lease
+	// is released, lower than a check since clients see target side errors
+	// too.
+	FeedbackScoreWeight = 0.1
+	// TrafficScoreWeight is the weight of a single gateway request in the
+	// score.
+	TrafficScoreWeight = 0.05
+	// TrafficLatencyWeight is the share of the latest gateway request in the
+	// moving average of the latency.
+	TrafficLatencyWeight = 0.2
 )
 
+type Timings struct {
+	Dns     time.Duration `yaml:"dns" json:"dns"`
+	Connect time.Duration `yaml:"connect" json:"connect"`
+	Tls     time.Duration `yaml:"tls" json:"tls"`
+	Ttfb    time.Duration `yaml:"ttfb" json:"ttfb"`
+}
+
+// TrafficStats are the outcomes of the requests the gateway sent through the
+// proxy.
+type TrafficStats struct {
+	SuccessCount int           `yaml:"success_count" json:"success_count"`
+	FailsCount   int           `yaml:"fails_count" json:"fails_count"`
+	FailStreak   int           `yaml:"fail_streak" json:"fail_streak"`
+	Latency      time.Duration `yaml:"latency" json:"latency"`
+}
+
+// Proxy is the stored form of a proxy. The json tags only serve decoding
+// API requests and take the credentials, responses go through View, which
+// leaves them out.
 type Proxy struct {
-	Ip              string        `yaml:"ip"`
-	Port            string        `yaml:"port"`
-	Protocol        string        `yaml:"protocol"`
-	LastCheckedTime time.Time     `yaml:"last_checked_time"`
-	PingTime        time.Duration `yaml:"ping_time"`
-	IsWork          bool          `yaml:"is_work"`
-	FailsCount      int           `yaml:"fails_count"`
-	SuccessCount    int           `yaml:"success_count"`
+	Ip               string               `yaml:"ip" json:"ip"`
+	Port             string               `yaml:"port" json:"port"`
+	Protocol         string               `yaml:"protocol" json:"protocol"`
+	LastCheckedTime  time.Time            `yaml:"last_checked_time" json:"last_checked_time"`
+	PingTime         time.Duration        `yaml:"ping_time" json:"ping_time"`
+	Timings          Timings              `yaml:"timings" json:"timings"`
+	IsWork           bool                 `yaml:"is_work" json:"is_work"`
+	FailsCount       int                  `yaml:"fails_count" json:"fails_count"`
+	SuccessCount     int                  `yaml:"success_count" json:"success_count"`
+	IsTampered       bool                 `yaml:"is_tampered" json:"is_tampered"`
+	TamperReason     string               `yaml:"tamper_reason" json:"tamper_reason"`
+	Capabilities     []string             `yaml:"capabilities" json:"capabilities"`
+	ExitIp           string               `yaml:"exit_ip" json:"exit_ip"`
+	JudgeIps         map[string]string    `yaml:"judge_ips,omitempty" json:"judge_ips,omitempty"`
+	StableExitChecks int                  `yaml:"stable_exit_checks,omitempty" json:"stable_exit_checks,omitempty"`
+	Tags             []string             `yaml:"tags" json:"tags"`
+	Throughput       float64              `yaml:"throughput" json:"throughput"`
+	Country          string               `yaml:"country" json:"country"`
+	Anonymity        string               `yaml:"anonymity" json:"anonymity"`
+	Score            float64              `yaml:"score" json:"score"`
+	Traffic          TrafficStats         `yaml:"traffic" json:"traffic"`
+	Source           string               `yaml:"source" json:"source"`
+	LastHandedOut    time.Time            `yaml:"-" json:"-"`
+	BannedDomains    map[string]time.Time `yaml:"banned_domains,omitempty" json:"banned_domains,omitempty"`
+	Username         string               `yaml:"username,omitempty" json:"username,omitempty"`
+	Password         string               `yaml:"password,omitempty" json:"password,omitempty"`
+	Hops             []Proxy              `yaml:"hops,omitempty" json:"hops,omitempty"`
+}
+
+// URL returns the proxy as scheme://user:pass@ip:port.
+func (p *Proxy) URL() *url.URL {
+	u := &url.URL{
+		Scheme: p.Protocol,
+		Host:   net.JoinHostPort(p.Ip, p.Port),
+	}
+	if p.Username != "" {
+		u.User = url.UserPassword(p.Username, p.Password)
+	}
+	return u
+}
+
+func (p *Proxy) HasCapability(capability string) bool {
+	for _, c := range p.Capabilities {
+		if c == capability {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) HasTag(tag string) bool {
+	for _, t := range p.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *Proxy) SetTag(tag string, on bool) {
+	if on == p.HasTag(tag) {
+		return
+	}
+
+	if on {
+		p.Tags = append(p.Tags, tag)
+		return
+	}
+
+	var tags []string
+	for _, t := range p.Tags {
+		if t != tag {
+			tags = append(tags, t)
+		}
+	}
+	p.Tags = tags
+}
+
+// AdjustScore moves the score towards 100 on success and towards 0 on
+// failure. The score is a moving average of the outcomes, weight is the share
+// of the latest one.
+func (p *Proxy) AdjustScore(success bool, weight float64) {
+	outcome := 0.0
+	if success {
+		outcome = 100
+	}
+	p.Score += (outcome - p.Score) * weight
+}
+
+// RecordTraffic adds the outcome of a gateway request to the traffic stats
+// and the score. latency is only taken into account on success.
+func (p *Proxy) RecordTraffic(success bool, latency time.Duration) {
+	if success {
+		p.Traffic.SuccessCount++
+		p.Traffic.FailStreak = 0
+		if p.Traffic.Latency == 0 {
+			p.Traffic.Latency = latency
+		} else {
+			p.Traffic.Latency += time.Duration(float64(latency-p.Traffic.Latency) * TrafficLatencyWeight)
+		}
+	} else {
+		p.Traffic.FailsCount++
+		p.Traffic.FailStreak++
+	}
+	p.AdjustScore(success, TrafficScoreWeight)
+}
+
+// A rotating proxy keeps its tag until this many checks in a row saw the
+// same exit IPs, so a slow rotation doesn't flip the tag on every check.
+const rotatingStableChecks = 3
+
+// RecordExitIps merges the exit IPs the judges of a check saw into the ones
+// seen before and stores the latest one as the exit IP. Judges that failed
+// keep their previous IP. A proxy is rotating when a judge sees a different
+// IP than on its previous answer. IPs of different judges are not compared,
+// a multi homed exit may answer each of them from another address.
+func (p *Proxy) RecordExitIps(judgeIps map[string]string, latest string) {
+	if len(judgeIps) == 0 {
+		return
+	}
+
+	changed := false
+	ips := make(map[string]string, len(p.JudgeIps)+len(judgeIps))
+	for judge, ip := range p.JudgeIps {
+		ips[judge] = ip
+	}
+	for judge, ip := range judgeIps {
+		if prev, ok := ips[judge]; ok && prev != ip {
+			changed = true
+		}
+		ips[judge] = ip
+	}
+	p.JudgeIps = ips
+	p.ExitIp = latest
+
+	switch {
+	case changed:
+		p.StableExitChecks = 0
+		p.SetTag(TAG_ROTATING, true)
+	case p.HasTag(TAG_ROTATING):
+		p.StableExitChecks++
+		if p.StableExitChecks >= rotatingStableChecks {
+			p.StableExitChecks = 0
+			p.SetTag(TAG_ROTATING, false)
+		}
+	}
+}
+
+// IsFailureStatus reports whether the status code most likely comes from the
+// proxy itself failing: it wants credentials, can't reach the target or no
+// response came at all. Other codes come from the target.
+func IsFailureStatus(code int) bool {
+	switch code {
+	case 407, 502:
+		return true
+	}
+	return code == 0
+}
+
+// IsBlockedStatus reports whether the target most likely refused the proxy
+// address. That is a matter of the target domain, not of the proxy.
+func IsBlockedStatus(code int) bool {
+	return code == 403 || code == 429
+}
+
+// NormalizeDomain lower cases a domain and strips the port, so bans match
+// however the client spelled it.
+func NormalizeDomain(domain string) string {
+	domain = strings.ToLower(strings.TrimSpace(domain))
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		domain = host
+	}
+	return strings.TrimSuffix(domain, ".")
+}
+
+// BanDomain bans the proxy for the domain and its subdomains until the given
+// time. Expired bans are dropped on the way.
+func (p *Proxy) BanDomain(domain string, until time.Time) {
+	now := time.Now()
+	bans := make(map[string]time.Time, len(p.BannedDomains)+1)
+	for d, t := range p.BannedDomains {
+		if t.After(now) {
+			bans[d] = t
+		}
+	}
+	bans[NormalizeDomain(domain)] = until
+	p.BannedDomains = bans
+}
+
+// IsBannedFor reports whether the proxy is banned for the domain or for one
+// of its parent domains.
+func (p *Proxy) IsBannedFor(domain string, now time.Time) bool {
+	domain = NormalizeDomain(domain)
+	for d, until := range p.BannedDomains {
+		if until.After(now) && (domain == d || strings.HasSuffix(domain, "."+d)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a deep copy that shares no slices or maps with p.
+func (p *Proxy) Clone() Proxy {
+	c := *p
+	c.Capabilities = append([]string(nil), p.Capabilities...)
+	c.Tags = append([]string(nil), p.Tags...)
+	if p.Hops != nil {
+		c.Hops = make([]Proxy, len(p.Hops))
+		for i := range p.Hops {
+			c.Hops[i] = p.Hops[i].Clone()
+		}
+	}
+	if p.JudgeIps != nil {
+		c.JudgeIps = make(map[string]string, len(p.JudgeIps))
+		for j, ip := range p.JudgeIps {
+			c.JudgeIps[j] = ip
+		}
+	}
+	if p.BannedDomains != nil {
+		c.BannedDomains = make(map[string]time.Time, len(p.BannedDomains))
+		for d, t := range p.BannedDomains {
+			c.BannedDomains[d] = t
+		}
+	}
+	return c
 }
 
+// The proxy list is owned by this package. All access goes through mtx, the
+// functions below return copies, and changes are made with Modify, so callers
+// never hold pointers into the list.
 var (
-	IsDirty             bool = false
-	proxiesList         []Proxy
+	mtx                 sync.RWMutex
+	proxies             = newIndex()
+	dirty               = make(map[string]struct{})
+	deleted             = make(map[string]Proxy)
 	checkPeriodDuration time.Duration
+	store               Store
+	saveMtx             sync.Mutex
+	isWorkDirty         atomic.Bool
+	workProxiesPath     = "./out/work_proxies.yaml"
 )
 
-func SetCheckPeriodDuration(t time.Duration) {
-	checkPeriodDuration = t
+func SetStore(s Store) {
+	store = s
+}
+
+func SetWorkProxiesPath(path string) {
+	workProxiesPath = path
 }
 
-func Find(p Proxy) int {
-	for i, pi := range proxiesList {
-		if pi.Ip == p.Ip && pi.Port == p.Port {
-			return i
+func Load() error {
+	pl, err := store.Load()
+	if err != nil {
+		return fmt.Errorf("Can't load proxies: %v", err)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	proxies = newIndex()
+	for i := range pl {
+		p := &pl[i]
+		legacy := *p
+		Normalize(p)
+		key := p.Key()
+
+		// Old records without a protocol are stored under another key, they
+		// are moved to the normalized one on the next save.
+		if legacyKey := legacy.Key(); legacyKey != key {
+			deleted[legacyKey] = legacy
+			markDirty(key)
+		}
+		// Of records that normalize to the same key the later one wins.
+		if !proxies.insert(p) {
+			proxies.remove(key)
+			proxies.insert(p)
 		}
 	}
+	proxies.watched = true
+	logger.LogDebug("[proxy] loaded %d proxies", proxies.len())
+	return nil
+}
+
+func SetCheckPeriodDuration(t time.Duration) {
+	mtx.Lock()
+	defer mtx.Unlock()
 
-	return -1
+	if t != checkPeriodDuration {
+		checkPeriodDuration = t
+		proxies.rebuildDue()
+	}
+}
+
+// Normalize fills the protocol for proxies added without one, it is a part
+// of the key. Countries are indexed in upper case.
+func Normalize(p *Proxy) {
+	if p.Protocol == "" {
+		p.Protocol = PROTO_HTTP
+	}
+	p.Country = strings.ToUpper(p.Country)
+}
+
+func markDirty(key string) {
+	dirty[key] = struct{}{}
+	isWorkDirty.Store(true)
+}
+
+func Find(p Proxy) (Proxy, bool) {
+	Normalize(&p)
+
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	if stored := proxies.get(p.Key()); stored != nil {
+		return stored.Clone(), true
+	}
+	return Proxy{}, false
+}
+
+// Get returns a copy of the proxy with the key.
+func Get(key string) (Proxy, bool) {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	if stored := proxies.get(key); stored != nil {
+		return stored.Clone(), true
+	}
+	return Proxy{}, false
 }
 
 func Delete(p Proxy) bool {
-	index := Find(p)
-	if index != -1 {
-		proxiesList = append(proxiesList[:index], proxiesList[index+1:]...)
-		IsDirty = true
-		logger.LogDebug("[proxy] deleted proxy '%s:%s'", p.Ip, p.Port)
-		return true
+	Normalize(&p)
+	key := p.Key()
+
+	mtx.Lock()
+	removed := proxies.remove(key)
+	if removed != nil {
+		delete(dirty, key)
+		deleted[key] = *removed
+		isWorkDirty.Store(true)
+		notify(CHANGE_REMOVED, removed)
 	}
-	return false
+	mtx.Unlock()
+
+	if removed == nil {
+		return false
+	}
+
+	logger.LogDebug("[proxy] deleted proxy '%s:%s'", p.Ip, p.Port)
+	return true
+}
+
+func add(p Proxy) bool {
+	Normalize(&p)
+	p = p.Clone()
+	if !proxies.insert(&p) {
+		return false
+	}
+
+	key := p.Key()
+	delete(deleted, key)
+	markDirty(key)
+	notify(CHANGE_ADDED, &p)
+	logger.LogDebug("[proxy] added proxy '%s:%s'", p.Ip, p.Port)
+	return true
 }
 
 func Add(p Proxy) {
-	index := Find(p)
+	mtx.Lock()
+	defer mtx.Unlock()
 
-	if index == -1 {
-		proxiesList = append(proxiesList, p)
-		IsDirty = true
-		logger.LogDebug("[proxy] added proxy '%s:%s'", p.Ip, p.Port)
-	}
+	add(p)
 }
 
-func AddList(pl []Proxy) {
+// AddList adds the proxies not in the list yet and returns how many were
+// added.
+func AddList(pl []Proxy) int {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	added := 0
 	for _, p := range pl {
-		Add(p)
+		if add(p) {
+			added++
+		}
 	}
+	return added
+}
+
+// Modify applies fn to the stored proxy under the lock, updates the indexes
+// and returns a copy of the result. It returns false if the proxy was deleted
+// in the meantime.
+func Modify(key string, fn func(p *Proxy)) (Proxy, bool) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	stored := proxies.get(key)
+	if stored == nil {
+		return Proxy{}, false
+	}
+
+	fn(stored)
+	proxies.reindexKey(key)
+	markDirty(key)
+
+	return stored.Clone(), true
 }
 
 func IsExpired(t time.Time) bool {
-	now := time.Now()
-	expirationTime := t.Add(checkPeriodDuration)
-	return now.After(expirationTime)
+	mtx.RLock()
+	period := checkPeriodDuration
+	mtx.RUnlock()
+
+	return time.Now().After(t.Add(period))
 }
 
-func GetLastNotCheckedOne() *Proxy {
-	for i := range proxiesList {
-		if IsExpired(proxiesList[i].LastCheckedTime) && proxiesList[i].FailsCount < MaxFailsCount {
-			proxiesList[i].LastCheckedTime = time.Now()
-			return &proxiesList[i]
-		}
-	}
+// recheckCh wakes the checker when a proxy is scheduled for an immediate
+// check.
+var recheckCh = make(chan struct{}, 1)
 
-	return nil
+func RecheckRequested() <-chan struct{} {
+	return recheckCh
 }
 
-func Save() error {
-	if !IsDirty {
-		return nil
+// Recheck makes the proxy due for a check now. Blocked proxies are not
+// checked anymore and stay as they are.
+func Recheck(key string) bool {
+	mtx.Lock()
+	stored := proxies.get(key)
+	if stored != nil {
+		stored.LastCheckedTime = time.Time{}
+		proxies.reindexKey(key)
+		markDirty(key)
 	}
+	mtx.Unlock()
 
-	yamlText, err := yaml.Marshal(proxiesList)
+	if stored == nil {
+		return false
+	}
 
-	if err != nil {
-		return fmt.Errorf("Can't pack to yaml: %v", err)
+	select {
+	case recheckCh <- struct{}{}:
+	default:
 	}
+	return true
+}
 
-	err = os.WriteFile("./out/all_proxies.yaml", yamlText, 0644)
+// GetLastNotCheckedOne takes the proxy with the earliest due check out of the
+// queue, marks it as checked now and returns a copy of it.
+func GetLastNotCheckedOne() *Proxy {
+	mtx.Lock()
+	defer mtx.Unlock()
 
-	if err != nil {
-		return fmt.Errorf("Can't write file: %v", err)
+	now := time.Now()
+	p := proxies.popDue(now)
+	if p == nil {
+		return nil
 	}
 
-	IsDirty = false
-	return nil
+	p.LastCheckedTime = now
+	proxies.reindexKey(p.Key())
+
+	result := p.Clone()
+	return &result
 }
 
-func GetWorkProxies() []*Proxy {
-	var result []*Proxy
+// Save writes the proxies changed since the last call to the store and
+// flushes it.
+func Save() error {
+	saveMtx.Lock()
+	defer saveMtx.Unlock()
+
+	mtx.Lock()
+	upserts := make([]Proxy, 0, len(dirty))
+	for key := range dirty {
+		if p := proxies.get(key); p != nil {
+			upserts = append(upserts, p.Clone())
+		}
+	}
+	deletes := make([]Proxy, 0, len(deleted))
+	for _, p := range deleted {
+		deletes = append(deletes, p)
+	}
+	dirty = make(map[string]struct{})
+	deleted = make(map[string]Proxy)
+	mtx.Unlock()
 
-	for i := range proxiesList {
-		if proxiesList[i].IsWork {
-			result = append(result, &proxiesList[i])
+	var failed []Proxy
+	var deleteErr error
+	for _, p := range deletes {
+		if err := store.Delete(p); err != nil {
+			failed = append(failed, p)
+			deleteErr = err
+		}
+	}
+	if len(failed) > 0 {
+		// A proxy added again since then is written by its upsert.
+		mtx.Lock()
+		for _, p := range failed {
+			key := p.Key()
+			if _, ok := deleted[key]; !ok && proxies.get(key) == nil {
+				deleted[key] = p
+			}
 		}
+		mtx.Unlock()
 	}
 
+	if len(upserts) > 0 {
+		if err := store.Upsert(upserts...); err != nil {
+			mtx.Lock()
+			for _, p := range upserts {
+				dirty[p.Key()] = struct{}{}
+			}
+			mtx.Unlock()
+			return fmt.Errorf("Can't store %d proxies: %v", len(upserts), err)
+		}
+	}
+	if deleteErr != nil {
+		return fmt.Errorf("Can't delete %d proxies: %v", len(failed), deleteErr)
+	}
+
+	return store.Flush()
+}
+
+func clones(pl []*Proxy) []Proxy {
+	result := make([]Proxy, len(pl))
+	for i, p := range pl {
+		result[i] = p.Clone()
+	}
 	return result
 }
 
+func GetWorkProxies() []Proxy {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return clones(proxies.workingProxies())
+}
+
+func GetProxiesByCountry(country string) []Proxy {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return clones(proxies.countryProxies(country))
+}
+
+func GetProxiesByProtocol(protocol string) []Proxy {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return clones(proxies.protocolProxies(protocol))
+}
+
 func SaveWorkProxies() error {
+	if !isWorkDirty.Swap(false) {
+		return nil
+	}
+
 	yamlText, err := yaml.Marshal(GetWorkProxies())
 
 	if err != nil {
+		isWorkDirty.Store(true)
 		return fmt.Errorf("Can't pack to yaml: %v", err)
 	}
 
-	err = os.WriteFile("./out/work_proxies.yaml", yamlText, 0644)
+	err = fileutil.WriteAtomic(workProxiesPath, yamlText, 0644)
 
 	if err != nil {
+		isWorkDirty.Store(true)
 		return fmt.Errorf("Can't write file: %v", err)
 	}
 
-	IsDirty = false
 	return nil
 }
 
 func GetAllProxies() []Proxy {
-	return proxiesList
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return clones(proxies.all())
 }
@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStore keeps the saved proxies in memory.
+type memStore struct {
+	mtx     sync.Mutex
+	proxies map[string]Proxy
+	// deleteErr fails every Delete when set.
+	deleteErr error
+}
+
+func newMemStore() *memStore {
+	return &memStore{proxies: make(map[string]Proxy)}
+}
+
+func (s *memStore) Load() ([]Proxy, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var pl []Proxy
+	for _, p := range s.proxies {
+		pl = append(pl, p.Clone())
+	}
+	return pl, nil
+}
+
+func (s *memStore) Upsert(pl ...Proxy) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, p := range pl {
+		s.proxies[p.Key()] = p.Clone()
+	}
+	return nil
+}
+
+func (s *memStore) Delete(p Proxy) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	if s.deleteErr != nil {
+		return s.deleteErr
+	}
+	delete(s.proxies, p.Key())
+	return nil
+}
+
+func (s *memStore) Query(filter func(p *Proxy) bool) ([]Proxy, error) {
+	return nil, nil
+}
+
+func (s *memStore) Iterate(fn func(p *Proxy) bool) error {
+	return nil
+}
+
+func (s *memStore) Flush() error {
+	return nil
+}
+
+func (s *memStore) Close() error {
+	return nil
+}
+
+func testKey(i int) string {
+	p := testProxy(i)
+	return p.Key()
+}
+
+func testProxy(i int) Proxy {
+	return Proxy{
+		Ip:       fmt.Sprintf("10.0.%d.%d", i/256, i%256),
+		Port:     "3128",
+		Protocol: PROTO_HTTP,
+		Country:  benchCountries[i%len(benchCountries)],
+	}
+}
+
+// checkIndex verifies that the secondary indexes agree with the proxies.
+func checkIndex(t *testing.T) {
+	t.Helper()
+
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	working := 0
+	for key, e := range proxies.byKey {
+		if key != e.proxy.Key() {
+			t.Errorf("proxy '%s' is stored under '%s'", e.proxy.Key(), key)
+		}
+		isWorking := e.proxy.IsWork && !e.proxy.IsTampered
+		if _, ok := proxies.working[key]; ok != isWorking {
+			t.Errorf("proxy '%s' working %v, in working bucket %v", key, isWorking, ok)
+		}
+		if isWorking {
+			working++
+		}
+		if e.proxy.Country != "" && proxies.byCountry[e.proxy.Country][key] != e {
+			t.Errorf("proxy '%s' is missing in country bucket '%s'", key, e.proxy.Country)
+		}
+		if proxies.byProtocol[e.proxy.Protocol][key] != e {
+			t.Errorf("proxy '%s' is missing in protocol bucket '%s'", key, e.proxy.Protocol)
+		}
+	}
+	if working != len(proxies.working) {
+		t.Errorf("working bucket holds %d proxies, %d are working", len(proxies.working), working)
+	}
+}
+
+// TestConcurrentAccess runs parser, checker and API traffic against the list
+// at the same time. It is meant to be run with -race.
+func TestConcurrentAccess(t *testing.T) {
+	const (
+		size    = 2000
+		rounds  = 300
+		workers = 4
+	)
+
+	SetStore(newMemStore())
+	resetProxies(nil)
+	SetCheckPeriodDuration(time.Hour)
+
+	var wg sync.WaitGroup
+	run := func(fn func(r *rand.Rand)) {
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(seed uint64) {
+				defer wg.Done()
+				r := rand.New(rand.NewPCG(seed, seed))
+				for i := 0; i < rounds; i++ {
+					fn(r)
+				}
+			}(uint64(w))
+		}
+	}
+
+	// Parser: adds batches, most of them already known.
+	run(func(r *rand.Rand) {
+		pl := make([]Proxy, 20)
+		for i := range pl {
+			pl[i] = testProxy(r.IntN(size))
+		}
+		AddList(pl)
+	})
+
+	// Checker: takes due proxies and writes the results back.
+	run(func(r *rand.Rand) {
+		p := GetLastNotCheckedOne()
+		if p == nil {
+			Recheck(testKey(r.IntN(size)))
+			return
+		}
+		isWork := r.IntN(2) == 0
+		Modify(p.Key(), func(stored *Proxy) {
+			stored.IsWork = isWork
+			stored.Capabilities = []string{CAP_CONNECT_443}
+			stored.RecordExitIps(map[string]string{"judge": "1.2.3.4"}, "1.2.3.4")
+			stored.AdjustScore(isWork, CheckScoreWeight)
+		})
+	})
+
+	// API: queries, picks, reports and deletes.
+	run(func(r *rand.Rand) {
+		switch r.IntN(6) {
+		case 0:
+			page := SelectWorking(Filter{Countries: []string{"US"}, Sort: "score", Limit: 10})
+			for _, p := range page.Proxies {
+				// Snapshots are copies, changing them must not reach the list.
+				p.Tags = append(p.Tags, "mutated")
+				p.Capabilities = nil
+			}
+		case 1:
+			PickWorkingExcept(Filter{}, PICK_LRU, 3, func(key string) bool {
+				return r.IntN(4) == 0
+			})
+		case 2:
+			PickWorking(Filter{}, PICK_WEIGHTED, 2)
+		case 3:
+			Delete(testProxy(r.IntN(size)))
+		case 4:
+			for _, p := range GetWorkProxies() {
+				p.ExitIp = "mutated"
+			}
+		case 5:
+			Modify(testKey(r.IntN(size)), func(p *Proxy) {
+				p.BanDomain("example.com", time.Now().Add(time.Hour))
+			})
+		}
+	})
+
+	// Flusher.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 50; i++ {
+			if err := Save(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	wg.Wait()
+	checkIndex(t)
+
+	for _, p := range GetAllProxies() {
+		if p.HasTag("mutated") || p.ExitIp == "mutated" {
+			t.Fatalf("proxy '%s' was changed through a snapshot", p.Key())
+		}
+	}
+}
+
+func TestSnapshotsAreCopies(t *testing.T) {
+	SetStore(newMemStore())
+	p := testProxy(1)
+	p.Hops = []Proxy{testProxy(2)}
+	p.BannedDomains = map[string]time.Time{"example.com": time.Now().Add(time.Hour)}
+	resetProxies([]Proxy{p})
+
+	got, ok := Get(p.Key())
+	if !ok {
+		t.Fatal("proxy not found")
+	}
+	got.Hops[0].Ip = "mutated"
+	got.BannedDomains["mutated"] = time.Now()
+	got.Tags = append(got.Tags, "mutated")
+
+	stored, _ := Get(p.Key())
+	if stored.Hops[0].Ip == "mutated" || len(stored.BannedDomains) != 1 || stored.HasTag("mutated") {
+		t.Fatalf("stored proxy was changed through a copy: %+v", stored)
+	}
+}
+
+func TestRecordExitIps(t *testing.T) {
+	type check struct {
+		ips      map[string]string
+		rotating bool
+	}
+	tests := []struct {
+		name   string
+		checks []check
+		want   map[string]string
+	}{
+		{
+			name: "stable",
+			checks: []check{
+				{map[string]string{"a": "1.1.1.1", "b": "2.2.2.2"}, false},
+				{map[string]string{"a": "1.1.1.1", "b": "2.2.2.2"}, false},
+			},
+			want: map[string]string{"a": "1.1.1.1", "b": "2.2.2.2"},
+		},
+		{
+			name: "failed judge keeps its ip",
+			checks: []check{
+				{map[string]string{"a": "1.1.1.1", "b": "2.2.2.2"}, false},
+				{map[string]string{"a": "1.1.1.1"}, false},
+				{map[string]string{"b": "2.2.2.2"}, false},
+			},
+			want: map[string]string{"a": "1.1.1.1", "b": "2.2.2.2"},
+		},
+		{
+			name: "judge back after failing sees another ip",
+			checks: []check{
+				{map[string]string{"a": "1.1.1.1", "b": "2.2.2.2"}, false},
+				{map[string]string{"a": "1.1.1.1"}, false},
+				{map[string]string{"b": "3.3.3.3"}, true},
+			},
+			want: map[string]string{"a": "1.1.1.1", "b": "3.3.3.3"},
+		},
+		{
+			name: "rotating until stable for several checks",
+			checks: []check{
+				{map[string]string{"a": "1.1.1.1"}, false},
+				{map[string]string{"a": "1.1.1.2"}, true},
+				{map[string]string{"a": "1.1.1.2"}, true},
+				{map[string]string{"a": "1.1.1.2"}, true},
+				{map[string]string{"a": "1.1.1.3"}, true},
+				{map[string]string{"a": "1.1.1.3"}, true},
+				{map[string]string{"a": "1.1.1.3"}, true},
+				{map[string]string{"a": "1.1.1.3"}, false},
+			},
+			want: map[string]string{"a": "1.1.1.3"},
+		},
+		{
+			name: "no judge answered",
+			checks: []check{
+				{map[string]string{"a": "1.1.1.1"}, false},
+				{map[string]string{"a": "1.1.1.2"}, true},
+				{nil, true},
+			},
+			want: map[string]string{"a": "1.1.1.2"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p Proxy
+			for i, c := range tt.checks {
+				latest := ""
+				for _, ip := range c.ips {
+					latest = ip
+				}
+				p.RecordExitIps(c.ips, latest)
+				if p.HasTag(TAG_ROTATING) != c.rotating {
+					t.Fatalf("check %d: rotating %v, want %v", i, p.HasTag(TAG_ROTATING), c.rotating)
+				}
+			}
+			if fmt.Sprint(p.JudgeIps) != fmt.Sprint(tt.want) {
+				t.Errorf("judge ips %v, want %v", p.JudgeIps, tt.want)
+			}
+		})
+	}
+}
+
+func TestFailedDeleteIsRetried(t *testing.T) {
+	s := newMemStore()
+	SetStore(s)
+	resetProxies([]Proxy{testProxy(1), testProxy(2)})
+	if err := Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.deleteErr = errors.New("disk full")
+	Delete(testProxy(1))
+	if err := Save(); err == nil {
+		t.Fatal("failed delete not reported")
+	}
+	if _, ok := s.proxies[testKey(1)]; !ok {
+		t.Fatal("proxy deleted from a failing store")
+	}
+
+	s.deleteErr = nil
+	if err := Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.proxies[testKey(1)]; ok {
+		t.Error("failed delete was not retried")
+	}
+	if _, ok := s.proxies[testKey(2)]; !ok {
+		t.Error("other proxy deleted")
+	}
+}
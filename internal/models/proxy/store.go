@@ -0,0 +1,18 @@
+package proxy
+
+// Store persists the proxy list. Implementations live in internal/storage.
+type Store interface {
+	Load() ([]Proxy, error)
+	Upsert(pl ...Proxy) error
+	Delete(p Proxy) error
+	Query(filter func(p *Proxy) bool) ([]Proxy, error)
+	Iterate(fn func(p *Proxy) bool) error
+	Flush() error
+	Close() error
+}
+
+// Key identifies a proxy by protocol, ip and port. It is safe to use in URL
+// paths.
+func (p *Proxy) Key() string {
+	return p.Protocol + "-" + p.Ip + "-" + p.Port
+}
@@ -0,0 +1,116 @@
+package proxy
+
+import (
+	"net"
+	"net/url"
+	"time"
+)
+
+// TimingsView is the JSON form of Timings, in milliseconds.
+type TimingsView struct {
+	DnsMs     int64 `json:"dns_ms"`
+	ConnectMs int64 `json:"connect_ms"`
+	TlsMs     int64 `json:"tls_ms"`
+	TtfbMs    int64 `json:"ttfb_ms"`
+}
+
+// TrafficView is the JSON form of TrafficStats.
+type TrafficView struct {
+	SuccessCount int   `json:"success_count"`
+	FailsCount   int   `json:"fails_count"`
+	FailStreak   int   `json:"fail_streak"`
+	LatencyMs    int64 `json:"latency_ms"`
+}
+
+// View is the form a proxy leaves the program in through the API, the JSON
+// exports and the event stream. It has no credentials and the hops of a
+// chain are only given as scheme://host:port.
+type View struct {
+	Key             string               `json:"key"`
+	Ip              string               `json:"ip"`
+	Port            string               `json:"port"`
+	Protocol        string               `json:"protocol"`
+	HasAuth         bool                 `json:"has_auth"`
+	Hops            []string             `json:"hops,omitempty"`
+	IsWork          bool                 `json:"is_work"`
+	LastCheckedTime time.Time            `json:"last_checked_time"`
+	PingMs          int64                `json:"ping_ms"`
+	Timings         TimingsView          `json:"timings"`
+	FailsCount      int                  `json:"fails_count"`
+	SuccessCount    int                  `json:"success_count"`
+	IsTampered      bool                 `json:"is_tampered"`
+	TamperReason    string               `json:"tamper_reason,omitempty"`
+	Capabilities    []string             `json:"capabilities"`
+	ExitIp          string               `json:"exit_ip,omitempty"`
+	Tags            []string             `json:"tags"`
+	Throughput      float64              `json:"throughput"`
+	Country         string               `json:"country,omitempty"`
+	Anonymity       string               `json:"anonymity,omitempty"`
+	Score           float64              `json:"score"`
+	Traffic         TrafficView          `json:"traffic"`
+	Source          string               `json:"source,omitempty"`
+	BannedDomains   map[string]time.Time `json:"banned_domains,omitempty"`
+}
+
+// HopURL returns the hop as scheme://host:port, without the credentials.
+func (p *Proxy) HopURL() string {
+	u := url.URL{Scheme: p.Protocol, Host: net.JoinHostPort(p.Ip, p.Port)}
+	return u.String()
+}
+
+// View returns the redacted form of the proxy.
+func (p *Proxy) View() View {
+	v := View{
+		Key:             p.Key(),
+		Ip:              p.Ip,
+		Port:            p.Port,
+		Protocol:        p.Protocol,
+		HasAuth:         p.Username != "" || p.Password != "",
+		IsWork:          p.IsWork,
+		LastCheckedTime: p.LastCheckedTime,
+		PingMs:          p.PingTime.Milliseconds(),
+		Timings: TimingsView{
+			DnsMs:     p.Timings.Dns.Milliseconds(),
+			ConnectMs: p.Timings.Connect.Milliseconds(),
+			TlsMs:     p.Timings.Tls.Milliseconds(),
+			TtfbMs:    p.Timings.Ttfb.Milliseconds(),
+		},
+		FailsCount:   p.FailsCount,
+		SuccessCount: p.SuccessCount,
+		IsTampered:   p.IsTampered,
+		TamperReason: p.TamperReason,
+		Capabilities: append([]string{}, p.Capabilities...),
+		ExitIp:       p.ExitIp,
+		Tags:         append([]string{}, p.Tags...),
+		Throughput:   p.Throughput,
+		Country:      p.Country,
+		Anonymity:    p.Anonymity,
+		Score:        p.Score,
+		Traffic: TrafficView{
+			SuccessCount: p.Traffic.SuccessCount,
+			FailsCount:   p.Traffic.FailsCount,
+			FailStreak:   p.Traffic.FailStreak,
+			LatencyMs:    p.Traffic.Latency.Milliseconds(),
+		},
+		Source: p.Source,
+	}
+	for i := range p.Hops {
+		v.Hops = append(v.Hops, p.Hops[i].HopURL())
+	}
+	if len(p.BannedDomains) > 0 {
+		v.BannedDomains = make(map[string]time.Time, len(p.BannedDomains))
+		for domain, until := range p.BannedDomains {
+			v.BannedDomains[domain] = until
+		}
+	}
+	return v
+}
+
+// Views returns the redacted forms of the proxies.
+func Views(pl []Proxy) []View {
+	views := make([]View, len(pl))
+	for i := range pl {
+		views[i] = pl[i].View()
+	}
+	return views
+}
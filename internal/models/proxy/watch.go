@@ -0,0 +1,30 @@
+package proxy
+
+// Changes of the list reported to the watchers.
+const (
+	CHANGE_ADDED   = "added"
+	CHANGE_REMOVED = "removed"
+	CHANGE_WORKING = "working"
+	CHANGE_DIED    = "died"
+)
+
+var watchers []func(change string, p Proxy)
+
+// Watch registers fn to be called with a copy of the proxy on every change of
+// the list. fn is called under the list lock, it must not block or call into
+// this package. Watchers must be registered before Load.
+func Watch(fn func(change string, p Proxy)) {
+	watchers = append(watchers, fn)
+}
+
+// notify reports a change to the watchers. It must be called under mtx.
+func notify(change string, p *Proxy) {
+	if len(watchers) == 0 {
+		return
+	}
+
+	c := p.Clone()
+	for _, fn := range watchers {
+		fn(change, c)
+	}
+}
@@ -2,11 +2,10 @@ package site
 
 import (
 	"fmt"
-	"os"
+	"sync"
 	"time"
 
 	"github.com/hightemp/proxy_parser_checker/internal/logger"
-	"gopkg.in/yaml.v3"
 )
 
 type Site struct {
@@ -14,17 +13,26 @@ type Site struct {
 	LastParsedTime time.Time
 }
 
+// The list is owned by this package, callers only get copies.
 var (
+	mtx                 sync.RWMutex
 	sites               []Site
-	IsDirty             = false
 	parsePeriodDuration time.Duration
+	store               Store
 )
 
+func SetStore(s Store) {
+	store = s
+}
+
 func SetParsePeriodDuration(t time.Duration) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
 	parsePeriodDuration = t
 }
 
-func FindUrl(url string) int {
+func findUrl(url string) int {
 	for i, si := range sites {
 		if si.Url == url {
 			return i
@@ -34,32 +42,69 @@ func FindUrl(url string) int {
 	return -1
 }
 
-func Add(url string) {
-	index := FindUrl(url)
+func FindUrl(url string) int {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return findUrl(url)
+}
+
+func add(url string) {
+	index := findUrl(url)
 
 	if index == -1 {
-		sites = append(sites, Site{Url: url})
-		IsDirty = true
+		s := Site{Url: url}
+		sites = append(sites, s)
+		if err := store.Upsert(s); err != nil {
+			logger.LogError("[site] Can't store site '%s': %v", url, err)
+		}
 		logger.LogDebug("[site] added site '%s'", url)
 	}
 }
 
+func Add(url string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	add(url)
+}
+
 func AddList(urlList []string) {
+	mtx.Lock()
+	defer mtx.Unlock()
+
 	for _, url := range urlList {
-		Add(url)
+		add(url)
 	}
 }
 
-func IsExpired(t time.Time) bool {
+func isExpired(t time.Time) bool {
 	now := time.Now()
 	expirationTime := t.Add(parsePeriodDuration)
 	return now.After(expirationTime)
 }
 
+func IsExpired(t time.Time) bool {
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return isExpired(t)
+}
+
+// GetLastOne returns a copy of the first expired site and marks it as parsed
+// now, so it is not handed out again while it is being parsed.
 func GetLastOne() *Site {
+	mtx.Lock()
+	defer mtx.Unlock()
+
 	for i := range sites {
-		if IsExpired(sites[i].LastParsedTime) {
-			return &sites[i]
+		if isExpired(sites[i].LastParsedTime) {
+			sites[i].LastParsedTime = time.Now()
+			if err := store.Upsert(sites[i]); err != nil {
+				logger.LogError("[site] Can't store site '%s': %v", sites[i].Url, err)
+			}
+			s := sites[i]
+			return &s
 		}
 	}
 
@@ -67,35 +112,27 @@ func GetLastOne() *Site {
 }
 
 func Save() error {
-	if !IsDirty {
-		return nil
-	}
-
-	yamlText, err := yaml.Marshal(sites)
-
-	if err != nil {
-		return fmt.Errorf("Can't pack to yaml: %v", err)
-	}
-
-	err = os.WriteFile("./out/sites_for_parsing.yaml", yamlText, 0644)
-
-	if err != nil {
-		return fmt.Errorf("Can't write file: %v", err)
-	}
-
-	IsDirty = false
-	return nil
+	return store.Flush()
 }
 
 func GetAllSites() []Site {
-	return sites
+	mtx.RLock()
+	defer mtx.RUnlock()
+
+	return append([]Site(nil), sites...)
 }
 
 func Delete(url string) bool {
-	index := FindUrl(url)
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	index := findUrl(url)
 	if index != -1 {
+		s := sites[index]
 		sites = append(sites[:index], sites[index+1:]...)
-		IsDirty = true
+		if err := store.Delete(s); err != nil {
+			logger.LogError("[site] Can't delete site '%s': %v", url, err)
+		}
 		logger.LogDebug("[site] deleted site '%s'", url)
 		return true
 	}
@@ -103,23 +140,14 @@ func Delete(url string) bool {
 }
 
 func Load() error {
-	yamlData, err := os.ReadFile("./out/sites_for_parsing.yaml")
+	sl, err := store.Load()
 	if err != nil {
-		if os.IsNotExist(err) {
-			return nil
-		}
-		return fmt.Errorf("Can't read file: %v", err)
+		return fmt.Errorf("Can't load sites: %v", err)
 	}
 
-	err = yaml.Unmarshal(yamlData, &sites)
-	if err != nil {
-		return fmt.Errorf("Can't unpack yaml: %v", err)
-	}
+	mtx.Lock()
+	defer mtx.Unlock()
 
+	sites = sl
 	return nil
 }
-
-func FileExists() bool {
-	_, err := os.Stat("./out/sites_for_parsing.yaml")
-	return os.IsExist(err)
-}
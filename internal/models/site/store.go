@@ -0,0 +1,16 @@
+package site
+
+// Store persists the list of sites. Implementations live in internal/storage.
+type Store interface {
+	Load() ([]Site, error)
+	Upsert(sl ...Site) error
+	Delete(s Site) error
+	Query(filter func(s *Site) bool) ([]Site, error)
+	Iterate(fn func(s *Site) bool) error
+	Flush() error
+	Close() error
+}
+
+func (s *Site) Key() string {
+	return s.Url
+}
@@ -2,6 +2,7 @@ package parser
 
 import (
 	"bytes"
+	"fmt"
 	"net/http"
 	"reflect"
 	"runtime"
@@ -9,7 +10,9 @@ import (
 	"time"
 
 	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/events"
 	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
 	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
 	"github.com/hightemp/proxy_parser_checker/internal/models/site"
 	"github.com/hightemp/proxy_parser_checker/internal/parser/parsers"
@@ -29,7 +32,11 @@ type WorkerPool struct {
 
 var (
 	parsersList []IParser
-	mtx         sync.Mutex
+
+	siteFetchesTotal = metrics.NewCounterVec("ppc_site_fetches_total",
+		"Site fetches by site and result.", "site", "result")
+	siteParsedTotal = metrics.NewCounterVec("ppc_site_parsed_proxies_total",
+		"Proxies parsed from a site, including already known ones.", "site")
 )
 
 func AddParser(p IParser) {
@@ -71,15 +78,25 @@ func (w *WorkerPool) work() {
 }
 
 func (w *WorkerPool) parse(lastSite *site.Site) {
-	mtx.Lock()
-	lastSite.LastParsedTime = time.Now()
-	mtx.Unlock()
-
 	logger.LogDebug("[parser] Making request to '%s'", lastSite.Url)
 	resp, err := w.client.Get(lastSite.Url)
 
 	if err != nil {
 		logger.LogError("[parser] Can't get url: '%s', %v", lastSite.Url, err)
+		siteFetchesTotal.Inc(lastSite.Url, "error")
+		events.SiteFailed(lastSite.Url, err)
+		return
+	}
+
+	defer resp.Body.Close()
+
+	// Error and challenge pages would parse as an empty list, a dead site
+	// has to look dead.
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("Bad response status %d", resp.StatusCode)
+		logger.LogError("[parser] Can't get url: '%s', %v", lastSite.Url, err)
+		siteFetchesTotal.Inc(lastSite.Url, "error")
+		events.SiteFailed(lastSite.Url, err)
 		return
 	}
 
@@ -87,35 +104,43 @@ func (w *WorkerPool) parse(lastSite *site.Site) {
 	_, err = bodyBuffer.ReadFrom(resp.Body)
 	if err != nil {
 		logger.LogError("[parser] Can't read body: %v", err)
+		siteFetchesTotal.Inc(lastSite.Url, "error")
+		events.SiteFailed(lastSite.Url, err)
 		return
 	}
 	body := bodyBuffer.String()
-	resp.Body.Close()
 
 	logger.LogDebug("[parser] parsing '%s'", lastSite.Url)
 
 	for _, p := range parsersList {
 		if p.IsTargetSite(lastSite.Url) {
 			logger.LogDebug("[parser] detected '%s'", reflect.TypeOf(p).String())
-			mtx.Lock()
-			proxy.AddList(p.ParseProxyList(body))
-			proxy.Save()
-			mtx.Unlock()
+			pl := p.ParseProxyList(body)
+			for i := range pl {
+				pl[i].Source = lastSite.Url
+			}
+			added := proxy.AddList(pl)
+			siteFetchesTotal.Inc(lastSite.Url, "success")
+			siteParsedTotal.Add(float64(len(pl)), lastSite.Url)
+			events.SiteParsed(lastSite.Url, len(pl), added)
 			return
 		}
 	}
 }
 
 func Loop(cfg *config.Config) {
-	w := NewWorkerPool(cfg)
-
+	// Parsers are registered before the workers start, the list is read
+	// without a lock.
 	AddParser(&parsers.ProxyListParser{})
 	AddParser(&parsers.TextListParser{})
 
+	w := NewWorkerPool(cfg)
+
 	site.SetParsePeriodDuration(cfg.ParsePeriodDuration)
-	if site.FileExists() {
-		site.Load()
-	} else {
+	if err := site.Load(); err != nil {
+		logger.LogError("[parser] %v", err)
+	}
+	if len(site.GetAllSites()) == 0 {
 		site.AddList(cfg.SitesForParsing)
 		site.Save()
 	}
@@ -0,0 +1,45 @@
+package parser
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+	"github.com/hightemp/proxy_parser_checker/internal/models/site"
+	"github.com/hightemp/proxy_parser_checker/internal/parser/parsers"
+)
+
+func TestFetchStatus(t *testing.T) {
+	AddParser(&parsers.TextListParser{})
+	defer func() { parsersList = nil }()
+
+	tests := []struct {
+		status int
+		want   string
+	}{
+		{http.StatusOK, events.TYPE_SITE_PARSED},
+		{http.StatusNotFound, events.TYPE_SITE_FAILED},
+		{http.StatusServiceUnavailable, events.TYPE_SITE_FAILED},
+	}
+	for _, tt := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+			w.Write([]byte("10.1.0.1:8080\n"))
+		}))
+
+		ch, cancel := events.Subscribe(events.Filter{}, 0)
+		w := &WorkerPool{client: srv.Client()}
+		w.parse(&site.Site{Url: srv.URL})
+		cancel()
+		srv.Close()
+
+		var got []string
+		for e := range ch {
+			got = append(got, e.Type)
+		}
+		if len(got) != 1 || got[0] != tt.want {
+			t.Errorf("status %d: events %v, want %s", tt.status, got, tt.want)
+		}
+	}
+}
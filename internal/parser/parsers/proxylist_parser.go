@@ -87,7 +87,7 @@ func (p *ProxyListParser) ParseProxyList(s string) []proxy.Proxy {
 		for _, proto := range protocols {
 			if protoStr, ok := proto.(string); ok {
 				protoLower := strings.ToLower(protoStr)
-				if protoLower == "http" || protoLower == "https" {
+				if protoLower == proxy.PROTO_HTTP || protoLower == proxy.PROTO_HTTPS || protoLower == proxy.PROTO_SOCKS5 {
 					hasValidProtocol = true
 					proxyType = protoLower
 					break
@@ -99,7 +99,16 @@ func (p *ProxyListParser) ParseProxyList(s string) []proxy.Proxy {
 			continue
 		}
 
-		proxyList = append(proxyList, proxy.Proxy{Ip: ip, Port: port, Protocol: proxyType})
+		country, _ := proxyMap["country"].(string)
+		anonymity, _ := proxyMap["anonymityLevel"].(string)
+
+		proxyList = append(proxyList, proxy.Proxy{
+			Ip:        ip,
+			Port:      port,
+			Protocol:  proxyType,
+			Country:   country,
+			Anonymity: strings.ToLower(anonymity),
+		})
 	}
 
 	return proxyList
@@ -16,7 +16,7 @@ func (p *TextListParser) IsTargetSite(url string) bool {
 func (p *TextListParser) ParseProxyList(s string) []proxy.Proxy {
 	var proxyList []proxy.Proxy
 
-	ipPortRegex := regexp.MustCompile(`^(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{1,5})$`)
+	ipPortRegex := regexp.MustCompile(`^(?:(https?|socks5)://)?(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}):(\d{1,5})$`)
 
 	lines := strings.Split(strings.TrimSpace(s), "\n")
 
@@ -28,14 +28,18 @@ func (p *TextListParser) ParseProxyList(s string) []proxy.Proxy {
 		}
 
 		matches := ipPortRegex.FindStringSubmatch(line)
-		if len(matches) != 3 {
+		if len(matches) != 4 {
 			continue
 		}
 
-		ip := matches[1]
-		port := matches[2]
+		protocol := matches[1]
+		if protocol == "" {
+			protocol = proxy.PROTO_HTTP
+		}
+		ip := matches[2]
+		port := matches[3]
 
-		proxyList = append(proxyList, proxy.Proxy{Ip: ip, Port: port, Protocol: proxy.PROTO_HTTP})
+		proxyList = append(proxyList, proxy.Proxy{Ip: ip, Port: port, Protocol: protocol})
 	}
 
 	return proxyList
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+)
+
+const (
+	// Heartbeats keep idle streams open through proxies and load balancers.
+	heartbeatInterval = 30 * time.Second
+	// A client that doesn't take a write for this long is disconnected.
+	streamWriteTimeout = 10 * time.Second
+)
+
+// lastEventId returns the id the client resumes after, from the
+// Last-Event-ID header sent by reconnecting EventSource clients or the
+// last_event_id parameter.
+func lastEventId(r *http.Request) (uint64, error) {
+	s := r.Header.Get("Last-Event-ID")
+	if s == "" {
+		s = r.URL.Query().Get("last_event_id")
+	}
+	if s == "" {
+		return 0, nil
+	}
+	id, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid last event id '%s'", s)
+	}
+	return id, nil
+}
+
+// originAllowed checks the Origin header sent by browsers. Pages of other
+// sites may only open the stream when allowed_origins lists them, browsers
+// don't apply the same origin policy to WebSockets. Clients that aren't
+// browsers send no Origin and are allowed.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+
+	origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+	for _, allowed := range config.GetConfig().AllowedOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+	if !originAllowed(r) {
+		jsonResponse(w, http.StatusForbidden, ProxyResponse{
+			Success: false,
+			Error:   "Origin not allowed",
+		})
+		return
+	}
+
+	filter, err := events.ParseFilter(r.URL.Query())
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	after, err := lastEventId(r)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if isWebSocket(r) {
+		serveWebSocket(w, r, filter, after)
+		return
+	}
+
+	rc := http.NewResponseController(w)
+	ch, cancel := events.Subscribe(filter, after)
+	defer cancel()
+
+	if origin := r.Header.Get("Origin"); origin != "" {
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Add("Vary", "Origin")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		logger.LogError("[server] Can't stream events: %v", err)
+		return
+	}
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		var chunk string
+		select {
+		case <-r.Context().Done():
+			return
+		case e, ok := <-ch:
+			if !ok {
+				// Dropped for falling behind, the client reconnects with
+				// Last-Event-ID.
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logger.LogError("[server] Can't pack event: %v", err)
+				continue
+			}
+			chunk = fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", e.Id, e.Type, data)
+		case <-heartbeat.C:
+			chunk = ": ping\n\n"
+		}
+
+		rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		if _, err := w.Write([]byte(chunk)); err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/lease"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+type leaseRequest struct {
+	Ttl string `json:"ttl"`
+}
+
+// decodeLeaseRequest reads the optional body of lease requests. An empty body
+// means the default TTL.
+func decodeLeaseRequest(r *http.Request) (time.Duration, error) {
+	var body leaseRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil && !errors.Is(err, io.EOF) {
+		return 0, fmt.Errorf("Invalid request body")
+	}
+	if body.Ttl == "" {
+		return 0, nil
+	}
+
+	ttl, err := time.ParseDuration(body.Ttl)
+	if err != nil || ttl <= 0 {
+		return 0, fmt.Errorf("Invalid ttl '%s'", body.Ttl)
+	}
+	return ttl, nil
+}
+
+func leaseErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, lease.ErrNotFound), errors.Is(err, lease.ErrUnavailable):
+		return http.StatusNotFound
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+func handleLeases(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		jsonResponse(w, http.StatusOK, ProxyResponse{
+			Success: true,
+			Data:    lease.GetAll(),
+		})
+	case http.MethodPost:
+		query := r.URL.Query()
+
+		filter, err := proxy.ParseFilter(query)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		mode := query.Get("mode")
+		if mode == "" {
+			mode = proxy.PICK_LRU
+		}
+
+		ttl, err := decodeLeaseRequest(r)
+		if err != nil {
+			jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		l, err := lease.Acquire(filter, mode, ttl, apiClient(r))
+		if err != nil {
+			jsonResponse(w, leaseErrorStatus(err), ProxyResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+
+		jsonResponse(w, http.StatusCreated, ProxyResponse{
+			Success: true,
+			Data:    l,
+		})
+	default:
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+	}
+}
+
+func handleLeaseHeartbeat(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	ttl, err := decodeLeaseRequest(r)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	l, err := lease.Heartbeat(r.PathValue("id"), ttl)
+	if err != nil {
+		jsonResponse(w, leaseErrorStatus(err), ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    l,
+	})
+}
+
+func handleLeaseRelease(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	var feedback lease.Feedback
+	if err := json.NewDecoder(r.Body).Decode(&feedback); err != nil && !errors.Is(err, io.EOF) {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	switch feedback.Outcome {
+	case "", "success", "failure":
+	default:
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid outcome '%s'", feedback.Outcome),
+		})
+		return
+	}
+
+	if err := lease.Release(r.PathValue("id"), feedback); err != nil {
+		jsonResponse(w, leaseErrorStatus(err), ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    "Lease released successfully",
+	})
+}
@@ -4,18 +4,25 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"time"
 
 	"github.com/hightemp/proxy_parser_checker/internal/checker"
 	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/export"
+	"github.com/hightemp/proxy_parser_checker/internal/lease"
 	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
 	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
 	"github.com/hightemp/proxy_parser_checker/internal/models/site"
 )
 
 type ProxyResponse struct {
-	Success bool        `json:"success"`
-	Data    interface{} `json:"data"`
-	Error   string      `json:"error,omitempty"`
+	Success    bool        `json:"success"`
+	Data       interface{} `json:"data"`
+	Total      *int        `json:"total,omitempty"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Error      string      `json:"error,omitempty"`
 }
 
 func jsonResponse(w http.ResponseWriter, status int, resp ProxyResponse) {
@@ -24,13 +31,43 @@ func jsonResponse(w http.ResponseWriter, status int, resp ProxyResponse) {
 	json.NewEncoder(w).Encode(resp)
 }
 
+// queryProxies applies the filters, sorting and pagination shared by the
+// proxy list endpoints. On invalid parameters it writes the error response
+// and returns false.
+func queryProxies(w http.ResponseWriter, r *http.Request, workingOnly bool) (proxy.Page, bool) {
+	filter, err := proxy.ParseFilter(r.URL.Query())
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return proxy.Page{}, false
+	}
+
+	if workingOnly {
+		return proxy.SelectWorking(filter), true
+	}
+	return proxy.SelectAll(filter), true
+}
+
+func pageResponse(page proxy.Page) ProxyResponse {
+	return ProxyResponse{
+		Success:    true,
+		Data:       proxy.Views(page.Proxies),
+		Total:      &page.Total,
+		NextCursor: page.NextCursor,
+	}
+}
+
 func handleProxies(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
-		jsonResponse(w, http.StatusOK, ProxyResponse{
-			Success: true,
-			Data:    proxy.GetAllProxies(),
-		})
+		page, ok := queryProxies(w, r, false)
+		if !ok {
+			return
+		}
+
+		jsonResponse(w, http.StatusOK, pageResponse(page))
 	case http.MethodPost:
 		var newProxy proxy.Proxy
 		if err := json.NewDecoder(r.Body).Decode(&newProxy); err != nil {
@@ -52,7 +89,7 @@ func handleProxies(w http.ResponseWriter, r *http.Request) {
 
 		jsonResponse(w, http.StatusCreated, ProxyResponse{
 			Success: true,
-			Data:    newProxy,
+			Data:    newProxy.View(),
 		})
 	case http.MethodDelete:
 		var proxyToDelete proxy.Proxy
@@ -92,6 +129,93 @@ func handleProxies(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+type proxyReport struct {
+	Outcome string `json:"outcome"`
+	Domain  string `json:"domain"`
+	Error   string `json:"error"`
+	Ban     bool   `json:"ban"`
+	BanTtl  string `json:"ban_ttl"`
+}
+
+// handleProxyReport takes client feedback about a proxy. A failure lowers the
+// score and schedules an immediate recheck, a ban hides the proxy from
+// queries for that domain.
+func handleProxyReport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	var report proxyReport
+	if err := json.NewDecoder(r.Body).Decode(&report); err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   "Invalid request body",
+		})
+		return
+	}
+
+	if report.Outcome != "success" && report.Outcome != "failure" {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid outcome '%s'", report.Outcome),
+		})
+		return
+	}
+	if report.Ban && report.Domain == "" {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   "Domain is required for a ban",
+		})
+		return
+	}
+
+	banTtl := config.GetConfig().Reports.BanTtlDuration
+	if report.BanTtl != "" {
+		var err error
+		banTtl, err = time.ParseDuration(report.BanTtl)
+		if err != nil || banTtl <= 0 {
+			jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Invalid ban_ttl '%s'", report.BanTtl),
+			})
+			return
+		}
+	}
+
+	key := r.PathValue("id")
+	success := report.Outcome == "success"
+
+	reported, ok := proxy.Modify(key, func(p *proxy.Proxy) {
+		p.AdjustScore(success, proxy.ReportScoreWeight)
+		if report.Ban {
+			p.BanDomain(report.Domain, time.Now().Add(banTtl))
+		}
+	})
+	if !ok {
+		jsonResponse(w, http.StatusNotFound, ProxyResponse{
+			Success: false,
+			Error:   "Proxy not found",
+		})
+		return
+	}
+
+	logger.LogInfo("[server] Proxy '%s' reported: %s, domain: '%s', error: '%s', ban: %v",
+		key, report.Outcome, report.Domain, report.Error, report.Ban)
+
+	if !success {
+		proxy.Recheck(key)
+	}
+
+	jsonResponse(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    reported.View(),
+	})
+}
+
 func handleSites(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case http.MethodGet:
@@ -191,13 +315,44 @@ func handleWorkingProxies(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	page, ok := queryProxies(w, r, true)
+	if !ok {
+		return
+	}
+
+	jsonResponse(w, http.StatusOK, pageResponse(page))
+}
+
+func handleFirstWorkingProxy(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	page, ok := queryProxies(w, r, true)
+	if !ok {
+		return
+	}
+	if len(page.Proxies) == 0 {
+		jsonResponse(w, http.StatusNotFound, ProxyResponse{
+			Success: false,
+			Error:   "No working proxies available",
+		})
+		return
+	}
+
 	jsonResponse(w, http.StatusOK, ProxyResponse{
 		Success: true,
-		Data:    proxy.GetWorkProxies(),
+		Data:    page.Proxies[0].View(),
 	})
 }
 
-func handleFirstWorkingProxy(w http.ResponseWriter, r *http.Request) {
+// handleRandomWorkingProxy returns a random working proxy, or a list of
+// count distinct ones when count is given.
+func handleRandomWorkingProxy(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
 			Success: false,
@@ -206,8 +361,43 @@ func handleFirstWorkingProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	workProxies := proxy.GetWorkProxies()
-	if len(workProxies) == 0 {
+	query := r.URL.Query()
+
+	filter, err := proxy.ParseFilter(query)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	mode := query.Get("mode")
+	if mode == "" {
+		mode = proxy.PICK_UNIFORM
+	}
+
+	count := 1
+	if v := query.Get("count"); v != "" {
+		count, err = strconv.Atoi(v)
+		if err != nil || count < 1 {
+			jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Invalid count '%s'", v),
+			})
+			return
+		}
+	}
+
+	picked, total, err := proxy.PickWorkingExcept(filter, mode, count, lease.Reserved())
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if len(picked) == 0 {
 		jsonResponse(w, http.StatusNotFound, ProxyResponse{
 			Success: false,
 			Error:   "No working proxies available",
@@ -215,12 +405,61 @@ func handleFirstWorkingProxy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if !query.Has("count") {
+		jsonResponse(w, http.StatusOK, ProxyResponse{
+			Success: true,
+			Data:    picked[0].View(),
+		})
+		return
+	}
+
 	jsonResponse(w, http.StatusOK, ProxyResponse{
 		Success: true,
-		Data:    workProxies[0],
+		Data:    proxy.Views(picked),
+		Total:   &total,
 	})
 }
 
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = export.FORMAT_PLAIN
+	}
+	if !export.IsValidFormat(format) {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Unknown format '%s'", format),
+		})
+		return
+	}
+
+	page, ok := queryProxies(w, r, true)
+	if !ok {
+		return
+	}
+
+	data, err := export.Render(format, page.Proxies)
+	if err != nil {
+		jsonResponse(w, http.StatusInternalServerError, ProxyResponse{
+			Success: false,
+			Error:   "Failed to render export",
+		})
+		return
+	}
+
+	w.Header().Set("Content-Type", export.ContentType(format))
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+}
+
 func handleStats(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
@@ -255,9 +494,10 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	checkRate := checker.GetCheckRate()
 	var estimatedMinutes float32 = 0
-	if checker.CheckRate > 0 {
-		estimatedMinutes = float32(notCheckedProxies) / (checker.CheckRate * 60)
+	if checkRate > 0 {
+		estimatedMinutes = float32(notCheckedProxies) / (checkRate * 60)
 	}
 
 	hours := int(estimatedMinutes) / 60
@@ -274,7 +514,7 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 		WorkedProxies:     workedProxies,
 		BlockedProxies:    blockedProxies,
 		NotCheckedProxies: notCheckedProxies,
-		CheckRate:         checker.CheckRate,
+		CheckRate:         checkRate,
 		EstimatedMinutes:  estimatedMinutes,
 		EstimatedTime:     estimatedTime,
 	}
@@ -285,10 +525,37 @@ func handleStats(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.Write(w); err != nil {
+		logger.LogError("[server] Can't write metrics: %v", err)
+	}
+}
+
 func Start() {
 	http.HandleFunc("/api/v1/proxies", handleProxies)
 	http.HandleFunc("/api/v1/proxies/working", handleWorkingProxies)
 	http.HandleFunc("/api/v1/proxies/working/first", handleFirstWorkingProxy)
+	http.HandleFunc("/api/v1/proxies/working/random", handleRandomWorkingProxy)
+	http.HandleFunc("/api/v1/proxies/export", handleExport)
+	http.HandleFunc("/api/v1/proxies/{id}/report", handleProxyReport)
+
+	http.HandleFunc("/api/v1/leases", handleLeases)
+	http.HandleFunc("/api/v1/leases/{id}/heartbeat", handleLeaseHeartbeat)
+	http.HandleFunc("/api/v1/leases/{id}/release", handleLeaseRelease)
+
+	http.HandleFunc("/api/v1/usage", handleUsage)
+
+	http.HandleFunc("/api/v1/events", handleEvents)
+
+	http.HandleFunc("/api/v1/webhooks/deliveries", handleWebhookDeliveries)
+
+	http.HandleFunc("/metrics", handleMetrics)
 
 	http.HandleFunc("/api/v1/sites", handleSites)
 
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/hightemp/proxy_parser_checker/internal/usage"
+)
+
+// apiClient names the client of an API request in the usage stats: the
+// X-Client-Id header, or the IP address of the client without it.
+func apiClient(r *http.Request) string {
+	if client := r.Header.Get("X-Client-Id"); client != "" {
+		return client
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func handleUsage(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	query := r.URL.Query()
+
+	kind := query.Get("kind")
+	if kind == "" {
+		kind = usage.KIND_PROXY
+	}
+	if !usage.IsValidKind(kind) {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid kind '%s'", kind),
+		})
+		return
+	}
+
+	windowParam := query.Get("window")
+	if windowParam == "" {
+		windowParam = "1h"
+	}
+	window, err := usage.ParseWindow(windowParam)
+	if err != nil {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	sortBy := query.Get("sort")
+	if sortBy == "" {
+		sortBy = "requests"
+	}
+	if !usage.IsValidSort(sortBy) {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid sort '%s'", sortBy),
+		})
+		return
+	}
+
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Invalid limit '%s'", s),
+			})
+			return
+		}
+	}
+
+	list := usage.Get(kind, window, sortBy)
+	total := len(list)
+	if limit > 0 && limit < total {
+		list = list[:limit]
+	}
+
+	jsonResponse(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    list,
+		Total:   &total,
+	})
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/hightemp/proxy_parser_checker/internal/webhook"
+)
+
+func handleWebhookDeliveries(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		jsonResponse(w, http.StatusMethodNotAllowed, ProxyResponse{
+			Success: false,
+			Error:   "Method not allowed",
+		})
+		return
+	}
+
+	query := r.URL.Query()
+
+	event := query.Get("event")
+	if event != "" && !webhook.IsValidEvent(event) {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid event '%s'", event),
+		})
+		return
+	}
+
+	state := query.Get("state")
+	if state != "" && !webhook.IsValidState(state) {
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   fmt.Sprintf("Invalid state '%s'", state),
+		})
+		return
+	}
+
+	limit := 0
+	if s := query.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 0 {
+			jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+				Success: false,
+				Error:   fmt.Sprintf("Invalid limit '%s'", s),
+			})
+			return
+		}
+	}
+
+	list := webhook.Deliveries(event, state)
+	total := len(list)
+	if limit > 0 && limit < total {
+		list = list[:limit]
+	}
+
+	jsonResponse(w, http.StatusOK, ProxyResponse{
+		Success: true,
+		Data:    list,
+		Total:   &total,
+	})
+}
@@ -0,0 +1,238 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+)
+
+// A minimal RFC 6455 server for the event stream: events go out as text
+// frames, the client may only ping and close.
+const (
+	websocketGuid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+	wsOpText  = 0x1
+	wsOpClose = 0x8
+	wsOpPing  = 0x9
+	wsOpPong  = 0xa
+
+	// Clients don't send data, larger frames end the connection.
+	wsMaxPayload = 4096
+
+	wsCloseNormal     = 1000
+	wsClosePolicy     = 1008
+	wsCloseTooLarge   = 1009
+	wsCloseUnexpected = 1011
+)
+
+var errFrameTooLarge = errors.New("Frame too large")
+
+func headerContains(h http.Header, name, token string) bool {
+	for _, v := range h.Values(name) {
+		for _, item := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(item), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func isWebSocket(r *http.Request) bool {
+	return headerContains(r.Header, "Connection", "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + websocketGuid))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// wsConn serializes the writes of the event loop and the read loop.
+type wsConn struct {
+	conn net.Conn
+	mtx  sync.Mutex
+}
+
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := make([]byte, 0, len(payload)+10)
+	frame = append(frame, 0x80|opcode)
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	frame = append(frame, payload...)
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	c.conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+func (c *wsConn) writeClose(code uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, code)
+	return c.writeFrame(wsOpClose, append(payload, reason...))
+}
+
+// readFrame reads a masked client frame and unmasks its payload.
+func readFrame(r *bufio.Reader) (byte, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	opcode := header[0] & 0x0f
+	if header[1]&0x80 == 0 {
+		return 0, nil, errors.New("Unmasked client frame")
+	}
+
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+	case 127:
+		var b [8]byte
+		if _, err := io.ReadFull(r, b[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(b[:])
+	}
+	if n > wsMaxPayload {
+		return 0, nil, errFrameTooLarge
+	}
+
+	var mask [4]byte
+	if _, err := io.ReadFull(r, mask[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return opcode, payload, nil
+}
+
+// readLoop answers pings and closes until the client closes the connection
+// or the read fails, then closes done.
+func (c *wsConn) readLoop(r *bufio.Reader, done chan<- struct{}) {
+	defer close(done)
+
+	for {
+		opcode, payload, err := readFrame(r)
+		if err != nil {
+			if errors.Is(err, errFrameTooLarge) {
+				c.writeClose(wsCloseTooLarge, "")
+			}
+			return
+		}
+
+		switch opcode {
+		case wsOpClose:
+			code := uint16(wsCloseNormal)
+			if len(payload) >= 2 {
+				code = binary.BigEndian.Uint16(payload)
+			}
+			c.writeClose(code, "")
+			return
+		case wsOpPing:
+			if err := c.writeFrame(wsOpPong, payload); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func serveWebSocket(w http.ResponseWriter, r *http.Request, filter events.Filter, after uint64) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		jsonResponse(w, http.StatusBadRequest, ProxyResponse{
+			Success: false,
+			Error:   "Invalid WebSocket handshake",
+		})
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		jsonResponse(w, http.StatusInternalServerError, ProxyResponse{
+			Success: false,
+			Error:   "WebSocket is not supported",
+		})
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		logger.LogError("[server] Can't take over the connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	ch, cancel := events.Subscribe(filter, after)
+	defer cancel()
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		return
+	}
+
+	c := &wsConn{conn: conn}
+	done := make(chan struct{})
+	go c.readLoop(rw.Reader, done)
+
+	heartbeat := time.NewTicker(heartbeatInterval)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case e, ok := <-ch:
+			if !ok {
+				c.writeClose(wsClosePolicy, "Too slow, reconnect with last_event_id")
+				return
+			}
+			data, err := json.Marshal(e)
+			if err != nil {
+				logger.LogError("[server] Can't pack event: %v", err)
+				c.writeClose(wsCloseUnexpected, "")
+				return
+			}
+			if err := c.writeFrame(wsOpText, data); err != nil {
+				return
+			}
+		case <-heartbeat.C:
+			if err := c.writeFrame(wsOpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
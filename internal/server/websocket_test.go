@@ -0,0 +1,273 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+)
+
+// clientFrame encodes a frame the way a client sends it. long forces the
+// 8 byte length even for short payloads.
+func clientFrame(opcode byte, payload []byte, masked, long bool) []byte {
+	frame := []byte{0x80 | opcode}
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case long:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	default:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	}
+	if !masked {
+		return append(frame, payload...)
+	}
+
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+// serverFrame reads an unmasked frame sent by the server.
+func serverFrame(t *testing.T, r *bufio.Reader) (byte, []byte) {
+	t.Helper()
+
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatalf("read frame: %v", err)
+	}
+	if header[0]&0x80 == 0 {
+		t.Fatalf("frame without FIN")
+	}
+	if header[1]&0x80 != 0 {
+		t.Fatalf("masked server frame")
+	}
+
+	n := uint64(header[1] & 0x7f)
+	switch n {
+	case 126:
+		var b [2]byte
+		io.ReadFull(r, b[:])
+		n = uint64(binary.BigEndian.Uint16(b[:]))
+		if n < 126 {
+			t.Fatalf("length %d sent in 2 bytes", n)
+		}
+	case 127:
+		var b [8]byte
+		io.ReadFull(r, b[:])
+		n = binary.BigEndian.Uint64(b[:])
+		if n <= 0xffff {
+			t.Fatalf("length %d sent in 8 bytes", n)
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatalf("read payload: %v", err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestWebsocketAccept(t *testing.T) {
+	// The example of RFC 6455 section 1.3.
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("accept key '%s'", got)
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	text := []byte("hello")
+	medium := bytes.Repeat([]byte("m"), 300)
+	full := bytes.Repeat([]byte("f"), wsMaxPayload)
+
+	tests := []struct {
+		name    string
+		frame   []byte
+		opcode  byte
+		payload []byte
+		err     error
+	}{
+		{"short", clientFrame(wsOpText, text, true, false), wsOpText, text, nil},
+		{"empty ping", clientFrame(wsOpPing, nil, true, false), wsOpPing, []byte{}, nil},
+		{"2 byte length", clientFrame(wsOpText, medium, true, false), wsOpText, medium, nil},
+		{"8 byte length", clientFrame(wsOpText, medium, true, true), wsOpText, medium, nil},
+		{"largest", clientFrame(wsOpText, full, true, false), wsOpText, full, nil},
+		{"too large", clientFrame(wsOpText, append(full, 'x'), true, false), 0, nil, errFrameTooLarge},
+		{"too large 8 byte length", clientFrame(wsOpText, append(full, 'x'), true, true), 0, nil, errFrameTooLarge},
+		{"truncated", clientFrame(wsOpText, text, true, false)[:8], 0, nil, io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opcode, payload, err := readFrame(bufio.NewReader(bytes.NewReader(tt.frame)))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if opcode != tt.opcode || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("opcode %#x, payload %q", opcode, payload)
+			}
+		})
+	}
+
+	_, _, err := readFrame(bufio.NewReader(bytes.NewReader(clientFrame(wsOpText, text, false, false))))
+	if err == nil {
+		t.Error("unmasked client frame accepted")
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	for _, n := range []int{0, 125, 126, 0xffff, 0x10000} {
+		server, client := net.Pipe()
+		c := &wsConn{conn: server}
+		payload := bytes.Repeat([]byte("p"), n)
+
+		go func() {
+			c.writeFrame(wsOpText, payload)
+			server.Close()
+		}()
+		opcode, got := serverFrame(t, bufio.NewReader(client))
+		if opcode != wsOpText || !bytes.Equal(got, payload) {
+			t.Errorf("length %d: opcode %#x, %d bytes", n, opcode, len(got))
+		}
+		client.Close()
+	}
+}
+
+// dialWebSocket opens a WebSocket to the server with the handshake headers
+// and returns the response to the handshake.
+func dialWebSocket(t *testing.T, srv *httptest.Server, query string, header http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+query, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return conn, r, resp
+}
+
+func TestWebSocketStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	conn, r, resp := dialWebSocket(t, srv, "?type=site_parsed", nil)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("accept key '%s'", got)
+	}
+
+	events.SiteFailed("https://example.com/skipped", errors.New("filtered out"))
+	events.SiteParsed("https://example.com/list", 3, 1)
+	opcode, payload := serverFrame(t, r)
+	if opcode != wsOpText {
+		t.Fatalf("opcode %#x", opcode)
+	}
+	var e events.Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != events.TYPE_SITE_PARSED || e.Site == nil || e.Site.Url != "https://example.com/list" {
+		t.Fatalf("event %s", payload)
+	}
+
+	conn.Write(clientFrame(wsOpPing, []byte("hi"), true, false))
+	if opcode, payload := serverFrame(t, r); opcode != wsOpPong || string(payload) != "hi" {
+		t.Fatalf("answer to ping: opcode %#x, %q", opcode, payload)
+	}
+
+	conn.Write(clientFrame(wsOpClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal), true, false))
+	opcode, payload = serverFrame(t, r)
+	if opcode != wsOpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != wsCloseNormal {
+		t.Fatalf("answer to close: opcode %#x, %q", opcode, payload)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection not closed: %v", err)
+	}
+}
+
+func TestWebSocketFrameTooLarge(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	conn, r, resp := dialWebSocket(t, srv, "", nil)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d", resp.StatusCode)
+	}
+
+	conn.Write(clientFrame(wsOpText, bytes.Repeat([]byte("x"), wsMaxPayload+1), true, false))
+	opcode, payload := serverFrame(t, r)
+	if opcode != wsOpClose || len(payload) < 2 || binary.BigEndian.Uint16(payload) != wsCloseTooLarge {
+		t.Fatalf("opcode %#x, %q", opcode, payload)
+	}
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(handleEvents))
+	defer srv.Close()
+
+	allowed := config.GetConfig().AllowedOrigins
+	defer func() { config.GetConfig().AllowedOrigins = allowed }()
+	config.GetConfig().AllowedOrigins = []string{"https://dashboard.example"}
+
+	tests := []struct {
+		origin string
+		status int
+	}{
+		{"", http.StatusSwitchingProtocols},
+		{srv.URL, http.StatusSwitchingProtocols},
+		{"https://dashboard.example", http.StatusSwitchingProtocols},
+		{"https://Dashboard.example/", http.StatusSwitchingProtocols},
+		{"https://evil.example", http.StatusForbidden},
+		{"null", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		header := http.Header{}
+		if tt.origin != "" {
+			header.Set("Origin", tt.origin)
+		}
+		conn, _, resp := dialWebSocket(t, srv, "", header)
+		if resp.StatusCode != tt.status {
+			t.Errorf("origin '%s': status %d, want %d", tt.origin, resp.StatusCode, tt.status)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,138 @@
+package boltstore
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+)
+
+const FormatVersion = 2
+
+var (
+	metaBucket = []byte("meta")
+	versionKey = []byte("version")
+)
+
+// Store keeps every item as a separate record in a bbolt bucket, so an
+// upsert writes only the changed item. Records are YAML with the same fields
+// as the YAML files.
+type Store[T any] struct {
+	db     *bolt.DB
+	bucket []byte
+	key    func(*T) string
+}
+
+func Open[T any](path string, bucket string, key func(*T) string) (*Store[T], error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("Can't open database %s: %v", path, err)
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists([]byte(bucket)); err != nil {
+			return err
+		}
+		return checkVersion(tx)
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Can't init database %s: %v", path, err)
+	}
+
+	return &Store[T]{
+		db:     db,
+		bucket: []byte(bucket),
+		key:    key,
+	}, nil
+}
+
+// checkVersion stamps a new database with FormatVersion and refuses to open
+// one written by a newer version.
+func checkVersion(tx *bolt.Tx) error {
+	meta, err := tx.CreateBucketIfNotExists(metaBucket)
+	if err != nil {
+		return err
+	}
+
+	if v := meta.Get(versionKey); v != nil {
+		version, err := strconv.Atoi(string(v))
+		if err != nil {
+			return fmt.Errorf("invalid format version '%s'", v)
+		}
+		if version > FormatVersion {
+			return fmt.Errorf("format version %d is newer than supported %d", version, FormatVersion)
+		}
+	}
+
+	return meta.Put(versionKey, []byte(strconv.Itoa(FormatVersion)))
+}
+
+func (s *Store[T]) Load() ([]T, error) {
+	return s.Query(func(*T) bool { return true })
+}
+
+// Upsert goes through bolt.DB.Batch, so concurrent upserts from the checker
+// workers are committed together.
+func (s *Store[T]) Upsert(items ...T) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		b := tx.Bucket(s.bucket)
+		for _, item := range items {
+			data, err := yaml.Marshal(item)
+			if err != nil {
+				return fmt.Errorf("Can't pack to yaml: %v", err)
+			}
+			if err := b.Put([]byte(s.key(&item)), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *Store[T]) Delete(item T) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(s.bucket).Delete([]byte(s.key(&item)))
+	})
+}
+
+func (s *Store[T]) Query(filter func(*T) bool) ([]T, error) {
+	var result []T
+
+	err := s.Iterate(func(item *T) bool {
+		if filter(item) {
+			result = append(result, *item)
+		}
+		return true
+	})
+
+	return result, err
+}
+
+// Iterate calls fn for every item in key order until fn returns false.
+func (s *Store[T]) Iterate(fn func(*T) bool) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(s.bucket).Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var item T
+			if err := yaml.Unmarshal(v, &item); err != nil {
+				return fmt.Errorf("Can't unpack record '%s': %v", k, err)
+			}
+			if !fn(&item) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Flush is a no-op, every write is committed immediately.
+func (s *Store[T]) Flush() error {
+	return nil
+}
+
+func (s *Store[T]) Close() error {
+	return s.db.Close()
+}
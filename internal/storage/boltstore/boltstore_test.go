@@ -0,0 +1,62 @@
+package boltstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// TestRecordsKeepCredentials checks that nothing the API hides is lost on
+// disk.
+func TestRecordsKeepCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxies.db")
+	checked := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	s, err := Open(path, "proxies", (*proxy.Proxy).Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.Upsert(proxy.Proxy{
+		Ip:              "10.0.0.1",
+		Port:            "8080",
+		Protocol:        proxy.PROTO_CHAIN,
+		LastCheckedTime: checked,
+		PingTime:        250 * time.Millisecond,
+		Username:        "user",
+		Password:        "pass",
+		Hops: []proxy.Proxy{
+			{Ip: "10.0.0.2", Port: "3128", Protocol: proxy.PROTO_HTTP, Username: "hop", Password: "hop-pass"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Close()
+
+	s, err = Open(path, "proxies", (*proxy.Proxy).Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	pl, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pl) != 1 {
+		t.Fatalf("loaded %d proxies, want 1", len(pl))
+	}
+
+	p := pl[0]
+	if p.Username != "user" || p.Password != "pass" {
+		t.Errorf("credentials '%s':'%s', want 'user':'pass'", p.Username, p.Password)
+	}
+	if len(p.Hops) != 1 || p.Hops[0].Password != "hop-pass" {
+		t.Errorf("hops %+v lost the hop password", p.Hops)
+	}
+	if p.PingTime != 250*time.Millisecond || !p.LastCheckedTime.Equal(checked) {
+		t.Errorf("ping time %v, last checked %v", p.PingTime, p.LastCheckedTime)
+	}
+}
@@ -0,0 +1,23 @@
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// RunFlusher calls flush every interval until ctx is cancelled. Callers mark
+// state dirty and let the flusher coalesce the writes instead of saving on
+// every change.
+func RunFlusher(ctx context.Context, interval time.Duration, flush func()) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			flush()
+		}
+	}
+}
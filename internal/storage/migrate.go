@@ -0,0 +1,128 @@
+package storage
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/models/site"
+	"github.com/hightemp/proxy_parser_checker/internal/storage/boltstore"
+	"github.com/hightemp/proxy_parser_checker/internal/storage/yamlstore"
+)
+
+// legacyDataDir is where files were written before data_dir existed,
+// relative to the working directory.
+const legacyDataDir = "./out"
+
+func prepareDataDir(dataDir string) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("Can't create data dir %s: %v", dataDir, err)
+	}
+
+	return migrateLegacyFiles(dataDir)
+}
+
+// migrateLegacyFiles moves the YAML files from ./out into a data dir that
+// doesn't have them yet, converted to the current format.
+func migrateLegacyFiles(dataDir string) error {
+	legacyDir, err := filepath.Abs(legacyDataDir)
+	if err != nil {
+		return nil
+	}
+	absDataDir, err := filepath.Abs(dataDir)
+	if err != nil || absDataDir == legacyDir {
+		return nil
+	}
+
+	files := []struct {
+		name    string
+		migrate func(src, dst string) (int, error)
+	}{
+		{ALL_PROXIES_FILE, func(src, dst string) (int, error) {
+			return migrateYaml(src, dst, (*proxy.Proxy).Key, proxy.Normalize)
+		}},
+		{SITES_FILE, func(src, dst string) (int, error) {
+			return migrateYaml(src, dst, (*site.Site).Key, nil)
+		}},
+	}
+
+	for _, f := range files {
+		src := filepath.Join(legacyDir, f.name)
+		dst := filepath.Join(dataDir, f.name)
+
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+
+		count, err := f.migrate(src, dst)
+		if err != nil {
+			return fmt.Errorf("Can't migrate %s: %v", src, err)
+		}
+		logger.LogInfo("[storage] migrated %d records from '%s' to '%s'", count, src, dst)
+	}
+
+	return nil
+}
+
+// migrateYaml reads a file in any format version, normalizes the records and
+// writes them to dst in the current format with an atomic write. Records
+// with the same key are merged, the later one wins.
+func migrateYaml[T any](src, dst string, key func(*T) string, normalize func(*T)) (int, error) {
+	items, err := yamlstore.New(src, key).Load()
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make(map[string]bool, len(items))
+	for i := range items {
+		if normalize != nil {
+			normalize(&items[i])
+		}
+		keys[key(&items[i])] = true
+	}
+	if len(keys) < len(items) {
+		logger.LogInfo("[storage] merged %d duplicate records of '%s'", len(items)-len(keys), src)
+	}
+
+	store := yamlstore.New(dst, key)
+	if err := store.Upsert(items...); err != nil {
+		return 0, err
+	}
+	if err := store.Flush(); err != nil {
+		return 0, err
+	}
+	return len(keys), nil
+}
+
+// importYaml fills an empty bolt store from the YAML file of the yaml
+// backend, so switching the backend keeps the data.
+func importYaml[T any](dst *boltstore.Store[T], path string, key func(*T) string) error {
+	isEmpty := true
+	err := dst.Iterate(func(*T) bool {
+		isEmpty = false
+		return false
+	})
+	if err != nil || !isEmpty {
+		return err
+	}
+
+	items, err := yamlstore.New(path, key).Load()
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return nil
+	}
+
+	if err := dst.Upsert(items...); err != nil {
+		return fmt.Errorf("Can't import %s: %v", path, err)
+	}
+	logger.LogInfo("[storage] imported %d records from '%s'", len(items), path)
+
+	return nil
+}
@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+	"github.com/hightemp/proxy_parser_checker/internal/models/site"
+	"github.com/hightemp/proxy_parser_checker/internal/storage/boltstore"
+	"github.com/hightemp/proxy_parser_checker/internal/storage/yamlstore"
+)
+
+const (
+	BACKEND_YAML = "yaml"
+	BACKEND_BOLT = "bolt"
+
+	ALL_PROXIES_FILE  = "all_proxies.yaml"
+	WORK_PROXIES_FILE = "work_proxies.yaml"
+	SITES_FILE        = "sites_for_parsing.yaml"
+	PROXIES_DB_FILE   = "proxies.db"
+	SITES_DB_FILE     = "sites.db"
+	USAGE_FILE        = "usage.yaml"
+)
+
+// Open prepares the data directory and creates the proxy and site stores for
+// the backend chosen in config.
+func Open(cfg *config.Config) (proxy.Store, site.Store, error) {
+	if err := prepareDataDir(cfg.DataDir); err != nil {
+		return nil, nil, err
+	}
+
+	switch cfg.Storage.Backend {
+	case "", BACKEND_YAML:
+		return yamlstore.New(filepath.Join(cfg.DataDir, ALL_PROXIES_FILE), (*proxy.Proxy).Key),
+			yamlstore.New(filepath.Join(cfg.DataDir, SITES_FILE), (*site.Site).Key),
+			nil
+	case BACKEND_BOLT:
+		proxyStore, err := boltstore.Open(filepath.Join(cfg.DataDir, PROXIES_DB_FILE), "proxies", (*proxy.Proxy).Key)
+		if err != nil {
+			return nil, nil, err
+		}
+		siteStore, err := boltstore.Open(filepath.Join(cfg.DataDir, SITES_DB_FILE), "sites", (*site.Site).Key)
+		if err != nil {
+			proxyStore.Close()
+			return nil, nil, err
+		}
+		err = importYaml(proxyStore, filepath.Join(cfg.DataDir, ALL_PROXIES_FILE), (*proxy.Proxy).Key)
+		if err == nil {
+			err = importYaml(siteStore, filepath.Join(cfg.DataDir, SITES_FILE), (*site.Site).Key)
+		}
+		if err != nil {
+			proxyStore.Close()
+			siteStore.Close()
+			return nil, nil, err
+		}
+		return proxyStore, siteStore, nil
+	default:
+		return nil, nil, fmt.Errorf("Unknown storage backend '%s'", cfg.Storage.Backend)
+	}
+}
@@ -0,0 +1,188 @@
+package yamlstore
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"github.com/hightemp/proxy_parser_checker/internal/fileutil"
+	"gopkg.in/yaml.v3"
+)
+
+// FormatVersion is written to every file. Version 1 files were a bare list
+// without a header, they are read as is and rewritten on the next flush.
+const FormatVersion = 2
+
+type document[T any] struct {
+	Version int `yaml:"version"`
+	Items   []T `yaml:"items"`
+}
+
+// Store keeps items in memory and writes the whole list to a single YAML
+// file on Flush.
+type Store[T any] struct {
+	mtx      sync.Mutex
+	flushMtx sync.Mutex
+	path     string
+	key      func(*T) string
+	items    []T
+	index    map[string]int
+	isDirty  bool
+}
+
+func New[T any](path string, key func(*T) string) *Store[T] {
+	return &Store[T]{
+		path:  path,
+		key:   key,
+		index: make(map[string]int),
+	}
+}
+
+func (s *Store[T]) Load() ([]T, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	s.items = nil
+	s.index = make(map[string]int)
+
+	yamlData, err := os.ReadFile(s.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Can't read file: %v", err)
+	}
+
+	var node yaml.Node
+	err = yaml.Unmarshal(yamlData, &node)
+	if err != nil {
+		return nil, fmt.Errorf("Can't unpack yaml: %v", err)
+	}
+
+	if len(node.Content) > 0 && node.Content[0].Kind == yaml.SequenceNode {
+		err = node.Decode(&s.items)
+		s.isDirty = true
+	} else if len(node.Content) > 0 {
+		var doc document[T]
+		err = node.Decode(&doc)
+		if err == nil && doc.Version > FormatVersion {
+			err = fmt.Errorf("format version %d is newer than supported %d", doc.Version, FormatVersion)
+		}
+		s.items = doc.Items
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Can't unpack %s: %v", s.path, err)
+	}
+
+	s.reindex()
+
+	return append([]T(nil), s.items...), nil
+}
+
+func (s *Store[T]) reindex() {
+	s.index = make(map[string]int, len(s.items))
+	for i := range s.items {
+		s.index[s.key(&s.items[i])] = i
+	}
+}
+
+func (s *Store[T]) Upsert(items ...T) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, item := range items {
+		k := s.key(&item)
+		if i, ok := s.index[k]; ok {
+			s.items[i] = item
+		} else {
+			s.index[k] = len(s.items)
+			s.items = append(s.items, item)
+		}
+	}
+	s.isDirty = true
+
+	return nil
+}
+
+func (s *Store[T]) Delete(item T) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	i, ok := s.index[s.key(&item)]
+	if !ok {
+		return nil
+	}
+
+	s.items = append(s.items[:i], s.items[i+1:]...)
+	s.reindex()
+	s.isDirty = true
+
+	return nil
+}
+
+func (s *Store[T]) Query(filter func(*T) bool) ([]T, error) {
+	var result []T
+
+	err := s.Iterate(func(item *T) bool {
+		if filter(item) {
+			result = append(result, *item)
+		}
+		return true
+	})
+
+	return result, err
+}
+
+// Iterate calls fn with a copy of every item until fn returns false.
+func (s *Store[T]) Iterate(fn func(*T) bool) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	for _, item := range s.items {
+		if !fn(&item) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// Flush marshals the list under the lock and writes it atomically outside of
+// it, so upserts are not blocked by disk I/O.
+func (s *Store[T]) Flush() error {
+	s.flushMtx.Lock()
+	defer s.flushMtx.Unlock()
+
+	s.mtx.Lock()
+	if !s.isDirty {
+		s.mtx.Unlock()
+		return nil
+	}
+	yamlText, err := yaml.Marshal(document[T]{Version: FormatVersion, Items: s.items})
+	s.isDirty = false
+	s.mtx.Unlock()
+
+	if err != nil {
+		s.markDirty()
+		return fmt.Errorf("Can't pack to yaml: %v", err)
+	}
+
+	err = fileutil.WriteAtomic(s.path, yamlText, 0644)
+
+	if err != nil {
+		s.markDirty()
+		return fmt.Errorf("Can't write file: %v", err)
+	}
+
+	return nil
+}
+
+func (s *Store[T]) markDirty() {
+	s.mtx.Lock()
+	s.isDirty = true
+	s.mtx.Unlock()
+}
+
+func (s *Store[T]) Close() error {
+	return s.Flush()
+}
@@ -0,0 +1,191 @@
+package upstream
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+)
+
+// SOCKS5 wire constants (RFC 1928, RFC 1929).
+const (
+	SOCKS5_VERSION = 0x05
+
+	SOCKS5_AUTH_NONE     = 0x00
+	SOCKS5_AUTH_PASSWORD = 0x02
+	SOCKS5_AUTH_NO_MATCH = 0xff
+
+	SOCKS5_CMD_CONNECT = 0x01
+
+	SOCKS5_ATYP_IPV4   = 0x01
+	SOCKS5_ATYP_DOMAIN = 0x03
+	SOCKS5_ATYP_IPV6   = 0x04
+
+	SOCKS5_REP_SUCCESS             = 0x00
+	SOCKS5_REP_GENERAL_FAILURE     = 0x01
+	SOCKS5_REP_NOT_ALLOWED         = 0x02
+	SOCKS5_REP_COMMAND_UNSUPPORTED = 0x07
+	SOCKS5_REP_ADDRESS_UNSUPPORTED = 0x08
+
+	// Username/password subnegotiation (RFC 1929).
+	SOCKS5_PASSWORD_VERSION = 0x01
+	SOCKS5_PASSWORD_SUCCESS = 0x00
+	SOCKS5_PASSWORD_FAILURE = 0x01
+)
+
+var ErrSocks5AddressType = errors.New("Unsupported SOCKS5 address type")
+
+var socks5Replies = map[byte]string{
+	0x01: "general failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+// AppendSocks5Address encodes host:port as ATYP, address and port.
+func AppendSocks5Address(b []byte, address string) ([]byte, error) {
+	host, portText, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portText, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid port '%s'", portText)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			b = append(b, SOCKS5_ATYP_IPV4)
+			b = append(b, ip4...)
+		} else {
+			b = append(b, SOCKS5_ATYP_IPV6)
+			b = append(b, ip.To16()...)
+		}
+	} else {
+		if len(host) > 255 {
+			return nil, fmt.Errorf("Host name too long: %d", len(host))
+		}
+		b = append(b, SOCKS5_ATYP_DOMAIN, byte(len(host)))
+		b = append(b, host...)
+	}
+
+	return binary.BigEndian.AppendUint16(b, uint16(port)), nil
+}
+
+// ReadSocks5Address reads ATYP, address and port and returns them as
+// host:port.
+func ReadSocks5Address(r io.Reader) (string, error) {
+	var atyp [1]byte
+	if _, err := io.ReadFull(r, atyp[:]); err != nil {
+		return "", err
+	}
+
+	var host string
+	switch atyp[0] {
+	case SOCKS5_ATYP_IPV4, SOCKS5_ATYP_IPV6:
+		ip := make(net.IP, net.IPv4len)
+		if atyp[0] == SOCKS5_ATYP_IPV6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case SOCKS5_ATYP_DOMAIN:
+		var length [1]byte
+		if _, err := io.ReadFull(r, length[:]); err != nil {
+			return "", err
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(r, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		return "", ErrSocks5AddressType
+	}
+
+	var port [2]byte
+	if _, err := io.ReadFull(r, port[:]); err != nil {
+		return "", err
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socks5Connect asks the SOCKS5 server on conn to connect to address.
+func socks5Connect(conn net.Conn, address, username, password string) error {
+	greeting := []byte{SOCKS5_VERSION, 1, SOCKS5_AUTH_NONE}
+	if username != "" {
+		greeting = []byte{SOCKS5_VERSION, 2, SOCKS5_AUTH_NONE, SOCKS5_AUTH_PASSWORD}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return fmt.Errorf("Can't write greeting: %v", err)
+	}
+
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return fmt.Errorf("Can't read auth method: %v", err)
+	}
+	if choice[0] != SOCKS5_VERSION {
+		return fmt.Errorf("Not a SOCKS5 server, version %d", choice[0])
+	}
+
+	switch choice[1] {
+	case SOCKS5_AUTH_NONE:
+	case SOCKS5_AUTH_PASSWORD:
+		if username == "" || len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("Server requires valid credentials")
+		}
+		auth := []byte{SOCKS5_PASSWORD_VERSION, byte(len(username))}
+		auth = append(auth, username...)
+		auth = append(auth, byte(len(password)))
+		auth = append(auth, password...)
+		if _, err := conn.Write(auth); err != nil {
+			return fmt.Errorf("Can't write credentials: %v", err)
+		}
+
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return fmt.Errorf("Can't read auth status: %v", err)
+		}
+		if status[1] != SOCKS5_PASSWORD_SUCCESS {
+			return fmt.Errorf("Authentication failed")
+		}
+	default:
+		return fmt.Errorf("No acceptable auth method")
+	}
+
+	req, err := AppendSocks5Address([]byte{SOCKS5_VERSION, SOCKS5_CMD_CONNECT, 0}, address)
+	if err != nil {
+		return fmt.Errorf("Invalid address '%s': %v", address, err)
+	}
+	if _, err := conn.Write(req); err != nil {
+		return fmt.Errorf("Can't write request: %v", err)
+	}
+
+	var reply [3]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("Can't read reply: %v", err)
+	}
+	if reply[1] != SOCKS5_REP_SUCCESS {
+		reason, ok := socks5Replies[reply[1]]
+		if !ok {
+			reason = fmt.Sprintf("code %d", reply[1])
+		}
+		return fmt.Errorf("Connect to %s rejected: %s", address, reason)
+	}
+
+	// The bound address is of no use for a tunnel, it is read and dropped.
+	if _, err := ReadSocks5Address(conn); err != nil {
+		return fmt.Errorf("Can't read bound address: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,168 @@
+// Package upstream opens connections through the proxies from the list. It is
+// shared by the checker and the gateway.
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// bufferedConn returns the bytes the CONNECT response reader has read ahead
+// before reading from the connection again.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// connectProxy opens a plain TCP connection to the proxy itself. For chains
+// it is a connection to the last hop, tunnelled through the earlier ones.
+func connectProxy(ctx context.Context, p *proxy.Proxy, timeout time.Duration) (net.Conn, error) {
+	if p.Protocol != proxy.PROTO_CHAIN {
+		return (&net.Dialer{Timeout: timeout}).DialContext(ctx, "tcp", net.JoinHostPort(p.Ip, p.Port))
+	}
+	if len(p.Hops) == 0 {
+		return nil, fmt.Errorf("Chain '%s' has no hops", p.Ip)
+	}
+
+	conn, err := dialProxy(ctx, &p.Hops[0], timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't dial hop 1: %v", err)
+	}
+	for i := 1; i < len(p.Hops); i++ {
+		next := &p.Hops[i]
+		conn, err = tunnel(conn, &p.Hops[i-1], net.JoinHostPort(next.Ip, next.Port), timeout)
+		if err != nil {
+			return nil, fmt.Errorf("Can't reach hop %d: %v", i+1, err)
+		}
+		if next.Protocol == proxy.PROTO_HTTPS && i < len(p.Hops)-1 {
+			conn, err = tlsHandshake(ctx, conn, timeout)
+			if err != nil {
+				return nil, fmt.Errorf("Can't reach hop %d: %v", i+1, err)
+			}
+		}
+	}
+	return conn, nil
+}
+
+// dialProxy opens a connection to the proxy itself, with TLS for https
+// proxies.
+func dialProxy(ctx context.Context, p *proxy.Proxy, timeout time.Duration) (net.Conn, error) {
+	conn, err := connectProxy(ctx, p, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if p.ExitHop().Protocol == proxy.PROTO_HTTPS {
+		return tlsHandshake(ctx, conn, timeout)
+	}
+	return conn, nil
+}
+
+func tlsHandshake(ctx context.Context, conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tlsConn := tls.Client(conn, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %v", err)
+	}
+	return tlsConn, nil
+}
+
+// Dial opens a tunnel to address through the proxy, with CONNECT for HTTP
+// proxies and a SOCKS5 connect request for SOCKS5 ones. Chains are dialed hop
+// by hop. timeout limits both the dial and every handshake.
+func Dial(ctx context.Context, p *proxy.Proxy, address string, timeout time.Duration) (net.Conn, error) {
+	conn, err := dialProxy(ctx, p, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Can't dial proxy: %v", err)
+	}
+	return tunnel(conn, p.ExitHop(), address, timeout)
+}
+
+// tunnel asks the proxy at the other end of conn to connect to address. The
+// connection is closed if it refuses.
+func tunnel(conn net.Conn, p *proxy.Proxy, address string, timeout time.Duration) (net.Conn, error) {
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if p.Protocol == proxy.PROTO_SOCKS5 {
+		if err := socks5Connect(conn, address, p.Username, p.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn.SetDeadline(time.Time{})
+		return conn, nil
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if auth := ProxyAuthorization(p); auth != "" {
+		req.Header.Set("Proxy-Authorization", auth)
+	}
+
+	err := req.Write(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Can't write CONNECT: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Can't read CONNECT response: %v", err)
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("CONNECT to %s rejected: %s", address, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// SetupTransport points the transport at the proxy. Requests go to the exit
+// hop, for chains the connection to it is opened through the earlier hops.
+func SetupTransport(t *http.Transport, p *proxy.Proxy, timeout time.Duration) {
+	t.Proxy = http.ProxyURL(p.ExitHop().URL())
+	if p.Protocol != proxy.PROTO_CHAIN {
+		t.DialContext = (&net.Dialer{Timeout: timeout}).DialContext
+		return
+	}
+
+	chain := p.Clone()
+	t.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		return connectProxy(ctx, &chain, timeout)
+	}
+}
+
+// ProxyAuthorization returns the Proxy-Authorization header value for the
+// proxy credentials, or an empty string if it has none.
+func ProxyAuthorization(p *proxy.Proxy) string {
+	if p.Username == "" {
+		return ""
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(p.Username+":"+p.Password))
+}
@@ -0,0 +1,302 @@
+// Package usage counts requests, traffic and errors per proxy and per client
+// of the gateway and the lease API, in rolling windows and in total.
+package usage
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/fileutil"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	KIND_PROXY  = "proxy"
+	KIND_CLIENT = "client"
+
+	FormatVersion = 1
+
+	// Windows up to an hour are summed from minute buckets, up to a day from
+	// hour buckets.
+	minuteBuckets = 60
+	hourBuckets   = 24
+
+	// Entries without activity for this long are dropped on save.
+	retention = 7 * 24 * time.Hour
+
+	// Client keys come from the clients, so their number and length are
+	// capped. Clients beyond MaxClients are counted together under
+	// OTHER_CLIENTS until idle ones are dropped.
+	MaxClients    = 10000
+	maxKeyLength  = 128
+	OTHER_CLIENTS = "(other)"
+)
+
+type Counters struct {
+	Requests int64 `yaml:"requests" json:"requests"`
+	BytesIn  int64 `yaml:"bytes_in" json:"bytes_in"`
+	BytesOut int64 `yaml:"bytes_out" json:"bytes_out"`
+	Errors   int64 `yaml:"errors" json:"errors"`
+}
+
+func (c *Counters) add(o Counters) {
+	c.Requests += o.Requests
+	c.BytesIn += o.BytesIn
+	c.BytesOut += o.BytesOut
+	c.Errors += o.Errors
+}
+
+// Usage is the usage of one proxy or client over a window.
+type Usage struct {
+	Key string `json:"key"`
+	Counters
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// buckets maps the start of a bucket, in units of its size since the epoch,
+// to the counters of that bucket.
+type buckets map[int64]Counters
+
+// add adds c to the bucket of slot and drops the buckets that fell out of
+// the last n.
+func (b buckets) add(slot int64, n int, c Counters) {
+	if _, ok := b[slot]; !ok {
+		for s := range b {
+			if s <= slot-int64(n) {
+				delete(b, s)
+			}
+		}
+	}
+	counters := b[slot]
+	counters.add(c)
+	b[slot] = counters
+}
+
+// sum returns the counters of the last n buckets up to slot.
+func (b buckets) sum(slot int64, n int) Counters {
+	var result Counters
+	for s, c := range b {
+		if s > slot-int64(n) && s <= slot {
+			result.add(c)
+		}
+	}
+	return result
+}
+
+type entry struct {
+	Total    Counters  `yaml:"total"`
+	Minutes  buckets   `yaml:"minutes"`
+	Hours    buckets   `yaml:"hours"`
+	LastSeen time.Time `yaml:"last_seen"`
+}
+
+type document struct {
+	Version int                          `yaml:"version"`
+	Kinds   map[string]map[string]*entry `yaml:"kinds"`
+}
+
+var (
+	mtx     sync.Mutex
+	kinds   = newKinds()
+	isDirty atomic.Bool
+	path    = "./out/usage.yaml"
+)
+
+func newKinds() map[string]map[string]*entry {
+	return map[string]map[string]*entry{
+		KIND_PROXY:  {},
+		KIND_CLIENT: {},
+	}
+}
+
+func IsValidKind(kind string) bool {
+	return kind == KIND_PROXY || kind == KIND_CLIENT
+}
+
+func SetPath(p string) {
+	path = p
+}
+
+// Record adds c to the usage of the proxy or client key. Empty keys are
+// ignored.
+func Record(kind, key string, c Counters) {
+	if key == "" {
+		return
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	entries, ok := kinds[kind]
+	if !ok {
+		return
+	}
+	if kind == KIND_CLIENT {
+		key = clientKey(entries, key)
+	}
+	e, ok := entries[key]
+	if !ok {
+		e = &entry{Minutes: make(buckets), Hours: make(buckets)}
+		entries[key] = e
+	}
+
+	now := time.Now()
+	e.Total.add(c)
+	e.Minutes.add(now.Unix()/60, minuteBuckets, c)
+	e.Hours.add(now.Unix()/3600, hourBuckets, c)
+	e.LastSeen = now
+	isDirty.Store(true)
+}
+
+// clientKey returns the key the usage of the client is counted under. It
+// must be called under mtx.
+func clientKey(entries map[string]*entry, key string) string {
+	if len(key) > maxKeyLength {
+		key = strings.ToValidUTF8(key[:maxKeyLength], "")
+	}
+	if _, ok := entries[key]; !ok && len(entries) >= MaxClients {
+		return OTHER_CLIENTS
+	}
+	return key
+}
+
+// ParseWindow parses a window like "5m", "1h" or "24h". "all" and an empty
+// string mean the totals.
+func ParseWindow(s string) (time.Duration, error) {
+	if s == "" || s == "all" {
+		return 0, nil
+	}
+	window, err := time.ParseDuration(s)
+	if err != nil || window < time.Minute || window > hourBuckets*time.Hour {
+		return 0, fmt.Errorf("Invalid window '%s', expected 1m to 24h or all", s)
+	}
+	return window, nil
+}
+
+// sortFields are the counters the usage can be ordered by, highest first.
+var sortFields = map[string]func(c *Counters) int64{
+	"requests":  func(c *Counters) int64 { return c.Requests },
+	"bytes_in":  func(c *Counters) int64 { return c.BytesIn },
+	"bytes_out": func(c *Counters) int64 { return c.BytesOut },
+	"errors":    func(c *Counters) int64 { return c.Errors },
+}
+
+func IsValidSort(field string) bool {
+	_, ok := sortFields[field]
+	return ok
+}
+
+// Get returns the usage of every proxy or client over the last window, or in
+// total if window is 0, ordered by the counter named by sortBy, highest
+// first. Windows are rounded up to whole minutes, or to whole hours above one
+// hour.
+func Get(kind string, window time.Duration, sortBy string) []Usage {
+	field, ok := sortFields[sortBy]
+	if !ok {
+		field = sortFields["requests"]
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	now := time.Now()
+	var result []Usage
+	for key, e := range kinds[kind] {
+		u := Usage{Key: key, LastSeen: e.LastSeen}
+		switch {
+		case window == 0:
+			u.Counters = e.Total
+		case window <= time.Hour:
+			u.Counters = e.Minutes.sum(now.Unix()/60, int((window+time.Minute-1)/time.Minute))
+		default:
+			u.Counters = e.Hours.sum(now.Unix()/3600, int((window+time.Hour-1)/time.Hour))
+		}
+		if u.Counters != (Counters{}) {
+			result = append(result, u)
+		}
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		a, b := field(&result[i].Counters), field(&result[j].Counters)
+		if a != b {
+			return a > b
+		}
+		return result[i].Key < result[j].Key
+	})
+	return result
+}
+
+// Load reads the usage saved by Save. A missing file is not an error.
+func Load() error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("Can't read file: %v", err)
+	}
+
+	var doc document
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("Can't unpack %s: %v", path, err)
+	}
+	if doc.Version > FormatVersion {
+		return fmt.Errorf("Can't unpack %s: format version %d is newer than supported %d", path, doc.Version, FormatVersion)
+	}
+
+	mtx.Lock()
+	defer mtx.Unlock()
+
+	kinds = newKinds()
+	for kind, entries := range doc.Kinds {
+		if _, ok := kinds[kind]; !ok {
+			continue
+		}
+		for key, e := range entries {
+			if e.Minutes == nil {
+				e.Minutes = make(buckets)
+			}
+			if e.Hours == nil {
+				e.Hours = make(buckets)
+			}
+			kinds[kind][key] = e
+		}
+	}
+	return nil
+}
+
+// Save writes the usage to the file if it changed since the last call and
+// drops the entries idle for longer than the retention.
+func Save() error {
+	if !isDirty.Swap(false) {
+		return nil
+	}
+
+	mtx.Lock()
+	now := time.Now()
+	for _, entries := range kinds {
+		for key, e := range entries {
+			if now.Sub(e.LastSeen) > retention {
+				delete(entries, key)
+			}
+		}
+	}
+	data, err := yaml.Marshal(document{Version: FormatVersion, Kinds: kinds})
+	mtx.Unlock()
+
+	if err != nil {
+		isDirty.Store(true)
+		return fmt.Errorf("Can't pack to yaml: %v", err)
+	}
+
+	if err := fileutil.WriteAtomic(path, data, 0644); err != nil {
+		isDirty.Store(true)
+		return fmt.Errorf("Can't write file: %v", err)
+	}
+	return nil
+}
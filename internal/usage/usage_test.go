@@ -0,0 +1,47 @@
+package usage
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestClientsAreCapped(t *testing.T) {
+	mtx.Lock()
+	kinds = newKinds()
+	mtx.Unlock()
+
+	for i := 0; i < MaxClients+5; i++ {
+		Record(KIND_CLIENT, fmt.Sprintf("client-%d", i), Counters{Requests: 1})
+	}
+	// Known clients are still counted under their own key.
+	Record(KIND_CLIENT, "client-0", Counters{Requests: 1})
+
+	usage := Get(KIND_CLIENT, 0, "requests")
+	if len(usage) != MaxClients+1 {
+		t.Fatalf("%d client entries, want %d", len(usage), MaxClients+1)
+	}
+	byKey := make(map[string]int64)
+	for _, u := range usage {
+		byKey[u.Key] = u.Requests
+	}
+	if byKey[OTHER_CLIENTS] != 5 {
+		t.Errorf("%s has %d requests, want 5", OTHER_CLIENTS, byKey[OTHER_CLIENTS])
+	}
+	if byKey["client-0"] != 2 {
+		t.Errorf("client-0 has %d requests, want 2", byKey["client-0"])
+	}
+}
+
+func TestLongClientKeyIsCut(t *testing.T) {
+	mtx.Lock()
+	kinds = newKinds()
+	mtx.Unlock()
+
+	Record(KIND_CLIENT, strings.Repeat("x", 10000), Counters{Requests: 1})
+
+	usage := Get(KIND_CLIENT, 0, "requests")
+	if len(usage) != 1 || len(usage[0].Key) > maxKeyLength {
+		t.Fatalf("got %d entries, key length %d", len(usage), len(usage[0].Key))
+	}
+}
@@ -0,0 +1,239 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/metrics"
+)
+
+const (
+	STATE_PENDING   = "pending"
+	STATE_DELIVERED = "delivered"
+	STATE_FAILED    = "failed"
+	STATE_DROPPED   = "dropped"
+
+	// Deliveries kept in the log, it lives in memory only.
+	logSize = 500
+
+	requestTimeout = 10 * time.Second
+)
+
+// Waits between the attempts of a delivery, shortened by the tests.
+var (
+	initialBackoff = 10 * time.Second
+	maxBackoff     = 10 * time.Minute
+)
+
+var states = []string{STATE_PENDING, STATE_DELIVERED, STATE_FAILED, STATE_DROPPED}
+
+func IsValidState(state string) bool {
+	return slices.Contains(states, state)
+}
+
+// Delivery is an event sent to a webhook, with all its attempts. Webhook is
+// the name of the webhook, never its URL. Payload is the posted body, the
+// same for every attempt.
+type Delivery struct {
+	Id         string          `json:"id"`
+	Webhook    string          `json:"webhook"`
+	Event      string          `json:"event"`
+	State      string          `json:"state"`
+	Attempts   int             `json:"attempts"`
+	StatusCode int             `json:"status_code,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Payload    json.RawMessage `json:"payload"`
+	CreatedAt  time.Time       `json:"created_at"`
+	UpdatedAt  time.Time       `json:"updated_at"`
+}
+
+type payload struct {
+	Id    string    `json:"id"`
+	Event string    `json:"event"`
+	Time  time.Time `json:"time"`
+	Data  any       `json:"data"`
+}
+
+var (
+	logMtx     sync.Mutex
+	deliveries []*Delivery
+
+	client = &http.Client{Timeout: requestTimeout}
+
+	deliveriesTotal = metrics.NewCounterVec("ppc_webhook_deliveries_total",
+		"Finished webhook deliveries by event and state.", "event", "state")
+)
+
+func newId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// newDelivery packs the event and adds it to the log as pending.
+func newDelivery(webhook, event string, data any) (*Delivery, error) {
+	now := time.Now()
+	d := &Delivery{
+		Id:        newId(),
+		Webhook:   webhook,
+		Event:     event,
+		State:     STATE_PENDING,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	var err error
+	d.Payload, err = json.Marshal(payload{Id: d.Id, Event: event, Time: now, Data: data})
+	if err != nil {
+		return nil, fmt.Errorf("Can't pack event '%s': %v", event, err)
+	}
+
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	if len(deliveries) == logSize {
+		copy(deliveries, deliveries[1:])
+		deliveries = deliveries[:logSize-1]
+	}
+	deliveries = append(deliveries, d)
+	return d, nil
+}
+
+func (d *Delivery) update(fn func(d *Delivery)) {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	fn(d)
+	d.UpdatedAt = time.Now()
+}
+
+func (d *Delivery) finish(state string, reason string) {
+	d.update(func(d *Delivery) {
+		d.State = state
+		if reason != "" {
+			d.Error = reason
+		}
+	})
+	deliveriesTotal.Inc(d.Event, state)
+	if state != STATE_DELIVERED {
+		logger.LogError("[webhook] Delivery of '%s' to '%s' %s: %s", d.Event, d.Webhook, state, d.Error)
+	}
+}
+
+// Deliveries returns the logged deliveries, newest first. Empty event and
+// state match all.
+func Deliveries(event, state string) []Delivery {
+	logMtx.Lock()
+	defer logMtx.Unlock()
+
+	var result []Delivery
+	for i := len(deliveries) - 1; i >= 0; i-- {
+		d := deliveries[i]
+		if (event == "" || d.Event == event) && (state == "" || d.State == state) {
+			result = append(result, *d)
+		}
+	}
+	return result
+}
+
+// Sign returns the hex HMAC-SHA256 of the body, sent as
+// "X-Webhook-Signature: sha256=<signature>".
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// isRetryable tells if a failed attempt may succeed later: network errors,
+// rate limits and server errors. Other statuses mean the request is wrong.
+func isRetryable(status int) bool {
+	return status == 0 || status == http.StatusTooManyRequests || status >= 500
+}
+
+// deliver sends the queued deliveries one by one, so a webhook gets its
+// events in order.
+func (h *hook) deliver(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case d := <-h.queue:
+			h.send(ctx, d)
+		}
+	}
+}
+
+// send posts the delivery until it succeeds or the attempts run out, the
+// wait doubles after every failed attempt.
+func (h *hook) send(ctx context.Context, d *Delivery) {
+	backoff := initialBackoff
+
+	for attempt := 1; ; attempt++ {
+		status, err := h.post(ctx, d)
+		if err == nil && status/100 != 2 {
+			err = fmt.Errorf("Bad response status %d", status)
+		}
+		d.update(func(d *Delivery) {
+			d.Attempts = attempt
+			d.StatusCode = status
+			d.Error = ""
+			if err != nil {
+				d.Error = err.Error()
+			}
+		})
+
+		if err == nil {
+			d.finish(STATE_DELIVERED, "")
+			return
+		}
+		// Deliveries interrupted by the shutdown stay pending.
+		if ctx.Err() != nil {
+			return
+		}
+		if !isRetryable(status) || attempt >= h.maxAttempts {
+			d.finish(STATE_FAILED, "")
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, maxBackoff)
+	}
+}
+
+func (h *hook) post(ctx context.Context, d *Delivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.Event)
+	req.Header.Set("X-Webhook-Delivery", d.Id)
+	if h.secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+Sign(h.secret, d.Payload))
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,326 @@
+// Package webhook posts pool and site events to the configured URLs. The
+// events are derived from the proxy and site events of the event bus and
+// from the completed check cycles.
+package webhook
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/checker"
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+	"github.com/hightemp/proxy_parser_checker/internal/logger"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+const (
+	EVENT_POOL_LOW        = "pool_low"
+	EVENT_POOL_RECOVERED  = "pool_recovered"
+	EVENT_SITE_DOWN       = "site_down"
+	EVENT_SITE_RECOVERED  = "site_recovered"
+	EVENT_CYCLE_COMPLETED = "cycle_completed"
+
+	// Deliveries waiting per webhook, more are dropped while the endpoint
+	// is retried.
+	queueSize = 100
+)
+
+var eventNames = []string{
+	EVENT_POOL_LOW,
+	EVENT_POOL_RECOVERED,
+	EVENT_SITE_DOWN,
+	EVENT_SITE_RECOVERED,
+	EVENT_CYCLE_COMPLETED,
+}
+
+func IsValidEvent(event string) bool {
+	return slices.Contains(eventNames, event)
+}
+
+// PoolData is sent with pool_low and pool_recovered.
+type PoolData struct {
+	Working    int    `json:"working"`
+	MinWorking int    `json:"min_working"`
+	Query      string `json:"query,omitempty"`
+}
+
+// SiteData is sent with site_down and site_recovered.
+type SiteData struct {
+	Url          string    `json:"url"`
+	FailingSince time.Time `json:"failing_since"`
+	Error        string    `json:"error,omitempty"`
+	Parsed       int       `json:"parsed,omitempty"`
+	Added        int       `json:"added,omitempty"`
+}
+
+// CycleData is sent with cycle_completed.
+type CycleData struct {
+	Total   int `json:"total"`
+	Working int `json:"working"`
+}
+
+type hook struct {
+	name          string
+	url           string
+	secret        string
+	events        []string
+	minWorking    int
+	query         string
+	filter        proxy.Filter
+	siteDownAfter time.Duration
+	maxAttempts   int
+	queue         chan *Delivery
+
+	// Trigger state, only used by the dispatcher.
+	poolLow   bool
+	sitesDown map[string]bool
+}
+
+func newHook(c config.WebhookConfig) (*hook, error) {
+	u, err := url.Parse(c.Url)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("Invalid webhook URL, an http or https URL is needed")
+	}
+	// The URL may carry secrets in the path or the query, only the name is
+	// shown.
+	name := c.Name
+	if name == "" {
+		name = u.Scheme + "://" + u.Host
+	}
+
+	if len(c.Events) == 0 {
+		return nil, fmt.Errorf("Webhook '%s' has no events", name)
+	}
+	for _, e := range c.Events {
+		if !IsValidEvent(e) {
+			return nil, fmt.Errorf("Webhook '%s': invalid event '%s'", name, e)
+		}
+	}
+	if (slices.Contains(c.Events, EVENT_POOL_LOW) || slices.Contains(c.Events, EVENT_POOL_RECOVERED)) && c.MinWorking <= 0 {
+		return nil, fmt.Errorf("Webhook '%s' needs min_working for pool events", name)
+	}
+
+	values, err := url.ParseQuery(c.Query)
+	if err != nil {
+		return nil, fmt.Errorf("Webhook '%s': invalid query '%s': %v", name, c.Query, err)
+	}
+	filter, err := proxy.ParseFilter(values)
+	if err != nil {
+		return nil, fmt.Errorf("Webhook '%s': %v", name, err)
+	}
+
+	return &hook{
+		name:          name,
+		url:           c.Url,
+		secret:        c.Secret,
+		events:        c.Events,
+		minWorking:    c.MinWorking,
+		query:         c.Query,
+		filter:        filter,
+		siteDownAfter: c.SiteDownAfterDuration,
+		maxAttempts:   c.MaxAttempts,
+		queue:         make(chan *Delivery, queueSize),
+		sitesDown:     make(map[string]bool),
+	}, nil
+}
+
+// fire queues the event if the webhook is subscribed to it.
+func (h *hook) fire(event string, data any) {
+	if !slices.Contains(h.events, event) {
+		return
+	}
+
+	d, err := newDelivery(h.name, event, data)
+	if err != nil {
+		logger.LogError("[webhook] %v", err)
+		return
+	}
+	select {
+	case h.queue <- d:
+	default:
+		d.finish(STATE_DROPPED, "Queue full")
+	}
+}
+
+// dispatcher turns the events of the bus and the check cycles into webhook
+// events. It runs in a single goroutine that owns the trigger state.
+type dispatcher struct {
+	hooks []*hook
+	// failingSince holds the first failure of every site that failed since
+	// its last successful parse.
+	failingSince map[string]time.Time
+	cycles       chan struct{}
+	// The pool isn't checked before the first check cycle completes, the
+	// working state loaded at start may be long out of date.
+	cycled bool
+}
+
+var busFilter = events.Filter{Types: []string{
+	events.TYPE_PROXY_WORKING,
+	events.TYPE_PROXY_DIED,
+	events.TYPE_PROXY_REMOVED,
+	events.TYPE_SITE_PARSED,
+	events.TYPE_SITE_FAILED,
+}}
+
+// Start checks the configured webhooks and delivers their events until ctx
+// is done. It registers a cycle hook, so it must be called before the
+// checker starts.
+func Start(ctx context.Context, cfg *config.Config) error {
+	if len(cfg.Webhooks) == 0 {
+		return nil
+	}
+
+	d := &dispatcher{
+		failingSince: make(map[string]time.Time),
+		cycles:       make(chan struct{}, 1),
+	}
+	for i, c := range cfg.Webhooks {
+		h, err := newHook(c)
+		if err != nil {
+			return fmt.Errorf("Webhooks[%d]: %v", i, err)
+		}
+		d.hooks = append(d.hooks, h)
+	}
+
+	checker.OnCycleComplete(func() {
+		select {
+		case d.cycles <- struct{}{}:
+		default:
+		}
+	})
+
+	ch, cancel := events.Subscribe(busFilter, 0)
+	go d.run(ctx, ch, cancel)
+	for _, h := range d.hooks {
+		go h.deliver(ctx)
+	}
+
+	logger.LogInfo("Started %d webhooks", len(d.hooks))
+	return nil
+}
+
+func (d *dispatcher) run(ctx context.Context, ch <-chan events.Event, cancel func()) {
+	var lastId uint64
+	// The pool is checked after the first cycle and then after every burst
+	// of changes.
+	poolChanged := false
+
+	for {
+		if poolChanged && d.cycled && len(ch) == 0 {
+			d.checkPool()
+			poolChanged = false
+		}
+
+		select {
+		case <-ctx.Done():
+			cancel()
+			return
+		case <-d.cycles:
+			d.cycleCompleted()
+			if !d.cycled {
+				d.cycled = true
+				poolChanged = true
+			}
+		case e, ok := <-ch:
+			if !ok {
+				// Dropped for falling behind, resume from the replay.
+				ch, cancel = events.Subscribe(busFilter, lastId)
+				poolChanged = true
+				continue
+			}
+			lastId = e.Id
+
+			switch e.Type {
+			case events.TYPE_SITE_PARSED:
+				d.siteParsed(e)
+			case events.TYPE_SITE_FAILED:
+				d.siteFailed(e)
+			default:
+				poolChanged = true
+			}
+		}
+	}
+}
+
+// checkPool fires pool_low when the working proxies matching the query of a
+// webhook drop below its minimum, and pool_recovered when they are back.
+func (d *dispatcher) checkPool() {
+	for _, h := range d.hooks {
+		if h.minWorking == 0 {
+			continue
+		}
+
+		working := proxy.CountWorking(h.filter)
+		low := working < h.minWorking
+		if low == h.poolLow {
+			continue
+		}
+		h.poolLow = low
+
+		data := PoolData{Working: working, MinWorking: h.minWorking, Query: h.query}
+		if low {
+			h.fire(EVENT_POOL_LOW, data)
+		} else {
+			h.fire(EVENT_POOL_RECOVERED, data)
+		}
+	}
+}
+
+// siteFailed fires site_down once a site has been failing for the time
+// configured for the webhook. Sites are fetched once per parse period, so
+// that is the precision.
+func (d *dispatcher) siteFailed(e events.Event) {
+	url := e.Site.Url
+	since, ok := d.failingSince[url]
+	if !ok {
+		since = e.Time
+		d.failingSince[url] = since
+	}
+
+	for _, h := range d.hooks {
+		if h.sitesDown[url] || e.Time.Sub(since) < h.siteDownAfter {
+			continue
+		}
+		h.sitesDown[url] = true
+		h.fire(EVENT_SITE_DOWN, SiteData{Url: url, FailingSince: since, Error: e.Site.Error})
+	}
+}
+
+// siteParsed fires site_recovered for the webhooks that reported the site
+// down.
+func (d *dispatcher) siteParsed(e events.Event) {
+	url := e.Site.Url
+	since, ok := d.failingSince[url]
+	if !ok {
+		return
+	}
+	delete(d.failingSince, url)
+
+	for _, h := range d.hooks {
+		if !h.sitesDown[url] {
+			continue
+		}
+		delete(h.sitesDown, url)
+		h.fire(EVENT_SITE_RECOVERED, SiteData{
+			Url:          url,
+			FailingSince: since,
+			Parsed:       e.Site.Parsed,
+			Added:        e.Site.Added,
+		})
+	}
+}
+
+func (d *dispatcher) cycleCompleted() {
+	data := CycleData{
+		Total:   proxy.CountAll(proxy.Filter{}),
+		Working: proxy.CountWorking(proxy.Filter{}),
+	}
+	for _, h := range d.hooks {
+		h.fire(EVENT_CYCLE_COMPLETED, data)
+	}
+}
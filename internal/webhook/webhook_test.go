@@ -0,0 +1,349 @@
+package webhook
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hightemp/proxy_parser_checker/internal/config"
+	"github.com/hightemp/proxy_parser_checker/internal/events"
+	"github.com/hightemp/proxy_parser_checker/internal/models/proxy"
+)
+
+// queued takes the deliveries already queued for the webhook.
+func queued(h *hook) []*Delivery {
+	var dl []*Delivery
+	for {
+		select {
+		case d := <-h.queue:
+			dl = append(dl, d)
+		default:
+			return dl
+		}
+	}
+}
+
+// receiver answers with the statuses in turn, the last one repeats, and
+// keeps the requests it got.
+type receiver struct {
+	mtx      sync.Mutex
+	statuses []int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rc *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+
+	rc.mtx.Lock()
+	defer rc.mtx.Unlock()
+
+	rc.requests = append(rc.requests, r)
+	rc.bodies = append(rc.bodies, body)
+	status := rc.statuses[min(len(rc.requests), len(rc.statuses))-1]
+	w.WriteHeader(status)
+}
+
+func testHook(t *testing.T, c config.WebhookConfig) *hook {
+	t.Helper()
+
+	if c.MaxAttempts == 0 {
+		c.MaxAttempts = 5
+	}
+	h, err := newHook(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+func TestNewHook(t *testing.T) {
+	const secretUrl = "https://hooks.example.com/services/T0KEN?key=s3cret"
+
+	tests := []struct {
+		name   string
+		config config.WebhookConfig
+		shown  string
+		err    bool
+	}{
+		{"host only", config.WebhookConfig{Url: secretUrl, Events: []string{EVENT_SITE_DOWN}}, "https://hooks.example.com", false},
+		{"named", config.WebhookConfig{Name: "alerts", Url: secretUrl, Events: []string{EVENT_SITE_DOWN}}, "alerts", false},
+		{"no events", config.WebhookConfig{Url: secretUrl}, "", true},
+		{"invalid event", config.WebhookConfig{Url: secretUrl, Events: []string{"proxy_died"}}, "", true},
+		{"pool without minimum", config.WebhookConfig{Url: secretUrl, Events: []string{EVENT_POOL_LOW}}, "", true},
+		{"invalid query", config.WebhookConfig{Url: secretUrl, Events: []string{EVENT_SITE_DOWN}, Query: "country=%zz"}, "", true},
+		{"not http", config.WebhookConfig{Url: "ftp://hooks.example.com/s3cret", Events: []string{EVENT_SITE_DOWN}}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := newHook(tt.config)
+			if tt.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				if strings.Contains(err.Error(), "s3cret") || strings.Contains(err.Error(), "T0KEN") {
+					t.Errorf("error shows the URL: %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			d, err := newDelivery(h.name, EVENT_SITE_DOWN, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if d.Webhook != tt.shown {
+				t.Errorf("delivery shows '%s', want '%s'", d.Webhook, tt.shown)
+			}
+		})
+	}
+}
+
+func TestDeliverySigned(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusOK}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	signed := testHook(t, config.WebhookConfig{Url: srv.URL, Secret: "s3cret", Events: []string{EVENT_CYCLE_COMPLETED}})
+	unsigned := testHook(t, config.WebhookConfig{Url: srv.URL, Events: []string{EVENT_CYCLE_COMPLETED}})
+
+	for _, h := range []*hook{signed, unsigned} {
+		h.fire(EVENT_CYCLE_COMPLETED, CycleData{Total: 10, Working: 4})
+		for _, d := range queued(h) {
+			h.send(context.Background(), d)
+			if d.State != STATE_DELIVERED {
+				t.Fatalf("delivery %s: %s", d.State, d.Error)
+			}
+		}
+	}
+
+	if len(rc.requests) != 2 {
+		t.Fatalf("%d requests, want 2", len(rc.requests))
+	}
+
+	r, body := rc.requests[0], rc.bodies[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write(body)
+	if got, want := r.Header.Get("X-Webhook-Signature"), "sha256="+hex.EncodeToString(mac.Sum(nil)); got != want {
+		t.Errorf("signature '%s', want '%s'", got, want)
+	}
+	if r.Header.Get("X-Webhook-Event") != EVENT_CYCLE_COMPLETED || r.Header.Get("X-Webhook-Delivery") == "" {
+		t.Errorf("headers %v", r.Header)
+	}
+
+	if got := rc.requests[1].Header.Get("X-Webhook-Signature"); got != "" {
+		t.Errorf("signature '%s' without a secret", got)
+	}
+}
+
+func TestDeliveryRetried(t *testing.T) {
+	backoff := initialBackoff
+	defer func() { initialBackoff = backoff }()
+	initialBackoff = 5 * time.Millisecond
+
+	tests := []struct {
+		name     string
+		statuses []int
+		state    string
+		attempts int
+	}{
+		{"recovers", []int{http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusNoContent}, STATE_DELIVERED, 3},
+		{"attempts run out", []int{http.StatusBadGateway}, STATE_FAILED, 3},
+		{"not retryable", []int{http.StatusBadRequest}, STATE_FAILED, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc := &receiver{statuses: tt.statuses}
+			srv := httptest.NewServer(rc)
+			defer srv.Close()
+
+			h := testHook(t, config.WebhookConfig{Url: srv.URL, Events: []string{EVENT_CYCLE_COMPLETED}, MaxAttempts: 3})
+			h.fire(EVENT_CYCLE_COMPLETED, CycleData{})
+			d := queued(h)[0]
+
+			start := time.Now()
+			h.send(context.Background(), d)
+			elapsed := time.Since(start)
+
+			if d.State != tt.state || d.Attempts != tt.attempts || len(rc.requests) != tt.attempts {
+				t.Fatalf("%s after %d attempts, %d requests", d.State, d.Attempts, len(rc.requests))
+			}
+			// The wait doubles after every failed attempt.
+			if wait := initialBackoff * (1<<(tt.attempts-1) - 1); elapsed < wait {
+				t.Errorf("sent in %v, want at least %v", elapsed, wait)
+			}
+			for i, body := range rc.bodies {
+				if string(body) != string(d.Payload) {
+					t.Errorf("attempt %d posted %s", i+1, body)
+				}
+			}
+		})
+	}
+}
+
+func TestPoolTriggersOncePerCrossing(t *testing.T) {
+	h := testHook(t, config.WebhookConfig{
+		Url:        "https://hooks.example.com",
+		Events:     []string{EVENT_POOL_LOW, EVENT_POOL_RECOVERED},
+		MinWorking: 2,
+		Query:      "country=ZZ",
+	})
+	d := &dispatcher{hooks: []*hook{h}}
+
+	add := func(i int, working bool) {
+		proxy.Add(proxy.Proxy{Ip: fmt.Sprintf("10.9.0.%d", i), Port: "3128", Protocol: proxy.PROTO_HTTP, Country: "ZZ", IsWork: working})
+	}
+	setWorking := func(i int, working bool) {
+		key := proxy.Proxy{Ip: fmt.Sprintf("10.9.0.%d", i), Port: "3128", Protocol: proxy.PROTO_HTTP}
+		proxy.Modify(key.Key(), func(p *proxy.Proxy) { p.IsWork = working })
+	}
+	check := func(want ...string) {
+		t.Helper()
+		// Checking twice without a change fires nothing new.
+		d.checkPool()
+		d.checkPool()
+
+		dl := queued(h)
+		if len(dl) != len(want) {
+			t.Fatalf("%d deliveries, want %v", len(dl), want)
+		}
+		for i, delivery := range dl {
+			if delivery.Event != want[i] {
+				t.Errorf("delivery %d is '%s', want '%s'", i, delivery.Event, want[i])
+			}
+		}
+	}
+
+	add(1, true)
+	add(2, false)
+	check(EVENT_POOL_LOW)
+	add(3, false)
+	check()
+	setWorking(2, true)
+	check(EVENT_POOL_RECOVERED)
+	setWorking(3, true)
+	check()
+	setWorking(1, false)
+	setWorking(2, false)
+	check(EVENT_POOL_LOW)
+}
+
+func TestSiteDownAfter(t *testing.T) {
+	late := testHook(t, config.WebhookConfig{
+		Url:                   "https://late.example.com",
+		Events:                []string{EVENT_SITE_DOWN, EVENT_SITE_RECOVERED},
+		SiteDownAfterDuration: 6 * time.Hour,
+	})
+	early := testHook(t, config.WebhookConfig{
+		Url:    "https://early.example.com",
+		Events: []string{EVENT_SITE_DOWN},
+	})
+	d := &dispatcher{hooks: []*hook{late, early}, failingSince: make(map[string]time.Time)}
+
+	const site = "https://example.com/list"
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	failed := func(after time.Duration) {
+		d.siteFailed(events.Event{
+			Type: events.TYPE_SITE_FAILED,
+			Time: start.Add(after),
+			Site: &events.Site{Url: site, Error: "timeout"},
+		})
+	}
+	fired := func(h *hook, want ...string) {
+		t.Helper()
+		dl := queued(h)
+		if len(dl) != len(want) {
+			t.Fatalf("%s: %d deliveries, want %v", h.name, len(dl), want)
+		}
+		for i, delivery := range dl {
+			if delivery.Event != want[i] {
+				t.Errorf("%s: delivery %d is '%s', want '%s'", h.name, i, delivery.Event, want[i])
+			}
+		}
+	}
+
+	failed(0)
+	fired(late)
+	fired(early, EVENT_SITE_DOWN)
+
+	failed(5 * time.Hour)
+	fired(late)
+	failed(6 * time.Hour)
+	fired(late, EVENT_SITE_DOWN)
+	failed(7 * time.Hour)
+	fired(late)
+	fired(early)
+
+	d.siteParsed(events.Event{Type: events.TYPE_SITE_PARSED, Time: start.Add(8 * time.Hour), Site: &events.Site{Url: site, Parsed: 10}})
+	fired(late, EVENT_SITE_RECOVERED)
+	// The webhook isn't subscribed to site_recovered.
+	fired(early)
+
+	// A new failure starts counting again.
+	failed(9 * time.Hour)
+	failed(14 * time.Hour)
+	fired(late)
+	failed(15 * time.Hour)
+	fired(late, EVENT_SITE_DOWN)
+}
+
+func TestDeliveryLogIsBounded(t *testing.T) {
+	var last *Delivery
+	for i := 0; i < logSize+100; i++ {
+		var err error
+		last, err = newDelivery("test", EVENT_CYCLE_COMPLETED, CycleData{Total: i})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dl := Deliveries("", "")
+	if len(dl) != logSize {
+		t.Fatalf("%d deliveries kept, want %d", len(dl), logSize)
+	}
+	if dl[0].Id != last.Id {
+		t.Errorf("newest delivery %s, want %s", dl[0].Id, last.Id)
+	}
+	if got := Deliveries(EVENT_SITE_DOWN, ""); len(got) != 0 {
+		t.Errorf("%d site_down deliveries", len(got))
+	}
+}
+
+func TestDeliveryStopsOnShutdown(t *testing.T) {
+	rc := &receiver{statuses: []int{http.StatusServiceUnavailable}}
+	srv := httptest.NewServer(rc)
+	defer srv.Close()
+
+	h := testHook(t, config.WebhookConfig{Url: srv.URL, Events: []string{EVENT_CYCLE_COMPLETED}})
+	h.fire(EVENT_CYCLE_COMPLETED, CycleData{})
+	d := queued(h)[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.send(ctx, d)
+		close(done)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send still waiting after the shutdown")
+	}
+	if got := Deliveries("", STATE_PENDING); len(got) == 0 || got[0].Id != d.Id {
+		t.Errorf("interrupted delivery isn't pending")
+	}
+}
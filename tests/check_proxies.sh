@@ -47,12 +47,12 @@ check_proxy() {
     return 1
 }
 
-PROXY_COUNT=$(yq '. | length' "$PROXY_FILE")
+PROXY_COUNT=$(yq '.items | length' "$PROXY_FILE")
 
 for ((i=0; i<$PROXY_COUNT; i++)); do
-    IP=$(yq ".[$i].ip" "$PROXY_FILE")
-    PORT=$(yq ".[$i].port" "$PROXY_FILE")
-    PROTOCOL=$(yq ".[$i].protocol" "$PROXY_FILE")
+    IP=$(yq ".items[$i].ip" "$PROXY_FILE")
+    PORT=$(yq ".items[$i].port" "$PROXY_FILE")
+    PROTOCOL=$(yq ".items[$i].protocol" "$PROXY_FILE")
     
     echo "-------------------"
     echo "Testing proxy #$((i+1))"